@@ -0,0 +1,80 @@
+package flow
+
+// Delivery rate estimation, following https://tools.ietf.org/html/draft-cheng-iccrg-delivery-rate-estimation
+
+// rateSample is computed for each ACK that delivers data.
+// priorDelivered and priorTime are f.delivered and f.deliveredTime at the time the most recently sent of the
+// delivered packets was sent.
+// sendElapsed and ackElapsed are the send and ack intervals of the sample, the longer of them is used to compute
+// the rate, so the rate is not overestimated when acks are compressed.
+// packet is the most recently sent of the packets delivered by the ACK.
+type rateSample struct {
+	priorDelivered uint64
+	priorTime      uint64
+	sendElapsed    uint64
+	ackElapsed     uint64
+	packet         *flowPacket
+}
+
+// onPacketSent snapshots the delivery state in the packet being sent.
+func (f *flow) onPacketSent(p *flowPacket) {
+	if len(f.inflight) == 0 {
+		// Nothing in flight, so the next sample starts from now.
+		f.firstSentTime = p.sentTime()
+		f.deliveredTime = p.sentTime()
+	}
+	p.firstSentTime = f.firstSentTime
+	p.delivered = f.delivered
+	p.deliveredTime = f.deliveredTime
+}
+
+// onPacketDelivered updates the delivery state and the rate sample with a packet delivered at the given time.
+func (f *flow) onPacketDelivered(rs *rateSample, p *flowPacket, now uint64) {
+	f.delivered += p.payloadSize()
+	f.deliveredTime = now
+	// Use the most recently sent packet for the sample.
+	if rs.packet == nil || p.delivered >= rs.priorDelivered {
+		rs.priorDelivered = p.delivered
+		rs.priorTime = p.deliveredTime
+		rs.sendElapsed = p.sentTime() - p.firstSentTime
+		rs.packet = p
+		f.firstSentTime = p.sentTime()
+	}
+}
+
+// deliveryRate finishes the sample and returns the rate in bits per second. The sample is invalid if no packet
+// was delivered or if the interval is shorter than min RTT, which happens for spuriously compressed acks.
+func (f *flow) deliveryRate(rs *rateSample) (rate float64, ok bool) {
+	if rs.packet == nil {
+		return 0, false
+	}
+	rs.ackElapsed = f.deliveredTime - rs.priorTime
+	interval := rs.sendElapsed
+	if rs.ackElapsed > interval {
+		interval = rs.ackElapsed
+	}
+	if interval == 0 || interval < f.minRTT {
+		return 0, false
+	}
+	return 8 * nsecInSec * float64(f.delivered-rs.priorDelivered) / float64(interval), true
+}
+
+// markSacked marks the inflight packets that are fully covered by the SACK blocks of the ack as delivered.
+// D-SACK blocks (below the cumulative ack) cover no inflight packets, so they are ignored here.
+func (f *flow) markSacked(ack *flowPacket, rs *rateSample, now uint64) {
+	blocks := ack.packet.TCP.Options().SACKBlocks
+	if len(blocks) == 0 {
+		return
+	}
+	for _, block := range blocks {
+		left := f.local.relative(block.Left)
+		right := f.local.relative(block.Right)
+		for _, p := range f.inflight {
+			if p.sacked || p.relativeSeqNum < left || p.expectedAckNum > right {
+				continue
+			}
+			p.sacked = true
+			f.onPacketDelivered(rs, p, now)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package flow
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"jakub-m/bdp/packet"
+	"jakub-m/bdp/pcap"
+	"log"
+	"sort"
+)
+
+const (
+	csvHeaderAll     = csvHeader + "\tconnection"
+	summaryHeaderAll = "# connection\tlocal\tremote\tpackets\tbytes sent\tbytes delivered\tsamples\tduration (usec)\tmean bandwidth (bps)\tmean rtt (usec)\tretransmissions\tspurious\thandshake\tstate\tpath mtu\tpath errors"
+)
+
+// connection is a single TCP connection tracked in the "all connections" mode, with totals for the summary.
+type connection struct {
+	id        int
+	endpoints endpoints
+	selector  *Selector
+	flow      *flow
+	packets   int
+	bytesSent uint64
+	samples   int
+	rttSum    uint64
+	firstSeen uint64
+	lastSeen  uint64
+}
+
+// connectionKey identifies a connection regardless of the direction of the packet. The lower (IP, port)
+// pair is always "a".
+type connectionKey struct {
+	a, b endpoint
+}
+
+type endpoint struct {
+	ip   pcap.IP
+	port uint16
+}
+
+func newConnectionKey(src, dst endpoint) connectionKey {
+	if src.less(dst) {
+		return connectionKey{src, dst}
+	}
+	return connectionKey{dst, src}
+}
+
+func (e endpoint) less(o endpoint) bool {
+	if c := bytes.Compare(e.ip[:], o.ip[:]); c != 0 {
+		return c < 0
+	}
+	return e.port < o.port
+}
+
+// ProcessAllPackets demultiplexes all the TCP connections in the capture and produces RTT and bandwidth
+// statistics for each of them. Connection id is added as the last column, so the first columns are the same
+// as in ProcessPackets. A summary of all the connections is printed at the end as comments. If vlan is not nil,
+// only the packets tagged with that VLAN ID are considered. If a tuple is reused after the connection was closed,
+// reset or after a FIN, the new connection gets a new id.
+func ProcessAllPackets(packets packet.Source, vlan *uint16, config *Config) error {
+	connections := make(map[connectionKey]*connection)
+	// terminated are the connections whose tuples were reused by new connections.
+	terminated := []*connection{}
+	lastID := 0
+
+	fmt.Println(csvHeaderAll)
+	if config.EventLog != nil {
+		fmt.Fprintln(config.EventLog, eventLogHeaderAll)
+	}
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if vlan != nil && !p.HasVLAN(*vlan) {
+			continue
+		}
+		if p.ICMP != nil {
+			consumeICMP(connections, p)
+			continue
+		}
+		if p.TCP == nil {
+			continue
+		}
+		if p.Checksum() == pcap.ChecksumBad {
+			// The tuple may be corrupted as well, so the packet is not attributed to any connection.
+			log.Printf("Dropping %s:%d > %s:%d (bad checksum)", p.IP.SourceIP(), p.TCP.SourcePort(), p.IP.DestIP(), p.TCP.DestPort())
+			continue
+		}
+		key := newConnectionKey(endpoint{p.IP.SourceIP(), p.TCP.SourcePort()}, endpoint{p.IP.DestIP(), p.TCP.DestPort()})
+		conn, ok := connections[key]
+		if ok && conn.flow.isNewInstance(p) {
+			log.Printf("Connection %d is %s, tuple reused by a new connection", conn.id, conn.flow.lifecycle.state)
+			terminated = append(terminated, conn)
+			ok = false
+		}
+		if !ok {
+			lastID++
+			conn = newConnection(lastID, p, config)
+			connections[key] = conn
+			log.Printf("New connection %d: %s", conn.id, conn.endpoints)
+		}
+		conn.consumePacket(p)
+	}
+
+	for _, c := range connections {
+		terminated = append(terminated, c)
+	}
+	printSummary(terminated)
+	return nil
+}
+
+// newConnection creates a connection from its first packet. The sender of the first packet is considered
+// local, unless the packet is SYN-ACK, in which case it is the remote.
+func newConnection(id int, p *packet.Packet, config *Config) *connection {
+	e := newEndpointsFromLocalSource(p)
+	if p.TCP.IsSyn() && p.TCP.IsAck() {
+		e = endpoints{
+			localIP:    e.remoteIP,
+			localPort:  e.remotePort,
+			remoteIP:   e.localIP,
+			remotePort: e.localPort,
+		}
+	}
+	conn := &connection{
+		id:        id,
+		endpoints: e,
+		selector: &Selector{
+			LocalIP:    e.localIP,
+			RemoteIP:   e.remoteIP,
+			LocalPort:  e.localPort,
+			RemotePort: e.remotePort,
+		},
+		firstSeen: p.Record.Timestamp(),
+	}
+	conn.flow = &flow{
+		config: config,
+		cbAckInFlight: func(stat *flowStat) {
+			conn.samples++
+			conn.rttSum += stat.rttNSec
+			fmt.Printf("%s\t%d\n", stat.CSVString(), conn.id)
+		},
+		cbWarning: func(msg string) {
+			fmt.Printf("# warning: connection %d: %s\n", conn.id, msg)
+		},
+	}
+	if config.EventLog != nil {
+		conn.flow.cbEvent = func(e *event) {
+			fmt.Fprintf(config.EventLog, "%s\t%d\n", e.CSVString(), conn.id)
+		}
+	}
+	return conn
+}
+
+func (c *connection) consumePacket(p *packet.Packet) {
+	c.packets++
+	c.lastSeen = p.Record.Timestamp()
+	if fp, err := c.flow.consumePacket(p, c.selector); err == nil {
+		log.Printf("[%d] %s", c.id, fp)
+	} else {
+		log.Printf("[%d] %s", c.id, err)
+	}
+	// Counted after the packet is consumed, since the flow endpoints are set from the first packet.
+	if c.flow.isDataFromSender(p) {
+		c.bytesSent += uint64(p.PayloadSize())
+	}
+}
+
+// consumeICMP passes an ICMP error to the connection of the packet it quotes, if there is such connection.
+func consumeICMP(connections map[connectionKey]*connection, p *packet.Packet) {
+	if !p.ICMP.IsPathError() {
+		return
+	}
+	quoted, err := p.ICMP.Quoted()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	key := newConnectionKey(endpoint{quoted.IP.SourceIP(), quoted.SourcePort}, endpoint{quoted.IP.DestIP(), quoted.DestPort})
+	conn, ok := connections[key]
+	if !ok {
+		return
+	}
+	if err := conn.flow.consumeICMP(p, conn.selector); err != nil {
+		log.Printf("[%d] %s", conn.id, err)
+	}
+}
+
+func printSummary(connections []*connection) {
+	sort.Slice(connections, func(i, k int) bool { return connections[i].id < connections[k].id })
+
+	fmt.Println(summaryHeaderAll)
+	for _, c := range connections {
+		duration := c.lastSeen - c.firstSeen
+		var meanRate, meanRTT float64
+		if duration > 0 {
+			meanRate = 8 * nsecInSec * float64(c.flow.delivered) / float64(duration)
+		}
+		if c.samples > 0 {
+			meanRTT = float64(c.rttSum) / float64(c.samples) / nsecInUsec
+		}
+		fmt.Printf("# %d\t%s\t%s\t%d\t%d\t%d\t%d\t%d\t%.0f\t%.3f\t%d\t%d\t%d\t%s\t%s\t%d\n", c.id,
+			formatEndpoint(c.endpoints.localIP, c.endpoints.localPort), formatEndpoint(c.endpoints.remoteIP, c.endpoints.remotePort),
+			c.packets, c.bytesSent, c.flow.delivered, c.samples, duration/nsecInUsec, meanRate, meanRTT,
+			c.flow.retransmits.total(), c.flow.retransmits.spurious, boolToInt(c.flow.handshakeSeen()), c.flow.lifecycle.state,
+			formatMTU(c.flow.path.mtu), c.flow.path.errors)
+	}
+}
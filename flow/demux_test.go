@@ -0,0 +1,114 @@
+package flow
+
+import (
+	"bytes"
+	"io"
+	"jakub-m/bdp/packet"
+	"os"
+	"strings"
+	"testing"
+)
+
+// sliceSource yields the packets of a slice.
+type sliceSource struct {
+	packets []*packet.Packet
+}
+
+func (s *sliceSource) Next() (*packet.Packet, error) {
+	if len(s.packets) == 0 {
+		return nil, io.EOF
+	}
+	p := s.packets[0]
+	s.packets = s.packets[1:]
+	return p, nil
+}
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() {
+		os.Stdout = stdout
+	}()
+	out := make(chan string)
+	go func() {
+		buf := &bytes.Buffer{}
+		io.Copy(buf, r)
+		out <- buf.String()
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestProcessAllPackets_InterleavedAndReused(t *testing.T) {
+	const other = 40001
+	segments := []testSegment{
+		{usec: 0, fromLocal: true, flags: testFlagSyn, seq: 1000},
+		{usec: 5000, fromLocal: true, flags: testFlagSyn, seq: 3000, localPort: other},
+		{usec: 20000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 5000, ack: 1001},
+		{usec: 20010, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001},
+		{usec: 25000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 6000, ack: 3001, localPort: other},
+		{usec: 25010, fromLocal: true, flags: testFlagAck, seq: 3001, ack: 6001, localPort: other},
+		{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		{usec: 35000, fromLocal: true, flags: testFlagAck, seq: 3001, ack: 6001, payload: 2000, localPort: other},
+		{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+		{usec: 55000, fromLocal: false, flags: testFlagAck, seq: 6001, ack: 5001, localPort: other},
+		// The first connection is closed, and its tuple is reused.
+		{usec: 60000, fromLocal: true, flags: testFlagFin | testFlagAck, seq: 2001, ack: 5001},
+		{usec: 80000, fromLocal: false, flags: testFlagFin | testFlagAck, seq: 5001, ack: 2002},
+		{usec: 80010, fromLocal: true, flags: testFlagAck, seq: 2002, ack: 5002},
+		{usec: 100000, fromLocal: true, flags: testFlagSyn, seq: 90000},
+		{usec: 120000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 7000, ack: 90001},
+		{usec: 120010, fromLocal: true, flags: testFlagAck, seq: 90001, ack: 7001},
+		{usec: 130000, fromLocal: true, flags: testFlagAck, seq: 90001, ack: 7001, payload: 500},
+		{usec: 160000, fromLocal: false, flags: testFlagAck, seq: 7001, ack: 90501},
+	}
+	packets := &sliceSource{readTestPackets(t, segments)}
+	out := captureStdout(t, func() {
+		if err := ProcessAllPackets(packets, nil, &Config{}); err != nil {
+			t.Error(err)
+		}
+	})
+
+	rows, summary := [][]string{}, [][]string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		switch {
+		case line == csvHeaderAll || line == summaryHeaderAll:
+		case strings.HasPrefix(line, "# "):
+			summary = append(summary, strings.Split(line, "\t"))
+		default:
+			rows = append(rows, strings.Split(line, "\t"))
+		}
+	}
+
+	assertEqual(t, len(rows), 3)
+	connectionColumn := len(strings.Split(csvHeaderAll, "\t")) - 1
+	for i, id := range []string{"1", "2", "3"} {
+		assertEqual(t, rows[i][connectionColumn], id)
+	}
+	// RTT of each connection.
+	assertEqual(t, rows[0][1], "20000.000")
+	assertEqual(t, rows[1][1], "20000.000")
+	assertEqual(t, rows[2][1], "30000.000")
+
+	assertEqual(t, len(summary), 3)
+	// id, local, remote, packets, bytes sent, bytes delivered, samples, duration, ..., handshake, state.
+	expected := [][]string{
+		{"# 1", "10.0.0.1:40000", "10.0.0.2:443", "8", "1000", "1000", "1"},
+		{"# 2", "10.0.0.1:40001", "10.0.0.2:443", "5", "2000", "2000", "1"},
+		{"# 3", "10.0.0.1:40000", "10.0.0.2:443", "5", "500", "500", "1"},
+	}
+	durations := []string{"80010", "50000", "60000"}
+	states := []string{"time-wait", "established", "established"}
+	for i, s := range summary {
+		assertEqual(t, s[:7], expected[i])
+		assertEqual(t, s[7], durations[i])
+		assertEqual(t, s[13], states[i])
+		assertEqual(t, s[12], "1")
+	}
+}
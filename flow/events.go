@@ -0,0 +1,34 @@
+package flow
+
+import (
+	"fmt"
+	"log"
+)
+
+const (
+	eventLogHeader    = "# timestamp (usec)\tevent\tdetails"
+	eventLogHeaderAll = eventLogHeader + "\tconnection"
+)
+
+// event is a notable moment of the flow, e.g. a retransmission, that is not a rate sample.
+type event struct {
+	relativeTimestampNSec uint64
+	name                  string
+	details               string
+}
+
+func (e *event) CSVString() string {
+	return fmt.Sprintf("%d\t%s\t%s", e.relativeTimestampNSec/nsecInUsec, e.name, e.details)
+}
+
+func (f *flow) emitEvent(relativeTimestamp uint64, name, details string) {
+	e := &event{
+		relativeTimestampNSec: relativeTimestamp,
+		name:                  name,
+		details:               details,
+	}
+	log.Printf("Event: %s", e.CSVString())
+	if f.cbEvent != nil {
+		f.cbEvent(e)
+	}
+}
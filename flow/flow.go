@@ -2,52 +2,136 @@ package flow
 
 import (
 	"fmt"
+	"io"
 	"jakub-m/bdp/packet"
 	"jakub-m/bdp/pcap"
 	"log"
+	"math"
 )
 
 const (
-	usecInSec = 1000 * 1000
-	csvHeader = "# bandwidth (bps)\trtt (usec)\twindow sent\twindow ack"
+	nsecInSec  = 1000 * 1000 * 1000
+	nsecInMsec = 1000 * 1000
+	nsecInUsec = 1000
+	csvHeader  = "# bandwidth (bps)\trtt (usec)\twindow sent\twindow ack\twindow known\trtt method\testimate\twindow used\tpath mtu\tpath errors"
 )
 
-// ProcessPackets iterates all the packets and produces RTT and bandwidth statistics.
-func ProcessPackets(packets []*packet.Packet, localIP, remoteIP *pcap.IPv4) error {
-	flow := &flow{}
+// Config tunes how the statistics are computed.
+// Direction tells which side sends the data. EventLog, if set, receives the flow events (e.g. retransmissions) as
+// tab separated rows. SplitSegments splits TSO/GSO super-segments into segments of MSS, as they are on the wire, so
+// the delivery rate is accounted as the receiver acknowledges them.
+type Config struct {
+	RTTMethod     RTTMethod
+	Direction     Direction
+	EventLog      io.Writer
+	SplitSegments bool
+}
+
+// ProcessPackets iterates all the packets and produces RTT and bandwidth statistics for the first
+// connection chosen by the selector.
+func ProcessPackets(packets packet.Source, selector *Selector, config *Config) error {
+	flow := &flow{
+		config: config,
+		cbAckInFlight: func(stat *flowStat) {
+			fmt.Println(stat.CSVString())
+		},
+	}
+	flow.cbWarning = func(msg string) {
+		fmt.Printf("# warning: %s\n", msg)
+	}
+	if config.EventLog != nil {
+		fmt.Fprintln(config.EventLog, eventLogHeader)
+		flow.cbEvent = func(e *event) {
+			fmt.Fprintln(config.EventLog, e.CSVString())
+		}
+	}
 
 	fmt.Println(csvHeader)
-	for _, f := range packets {
-		if fp, err := flow.consumePacket(f, localIP, remoteIP); err == nil {
+	for {
+		f, err := packets.Next()
+		if err == io.EOF {
+			fmt.Printf("# retransmissions: %s\n", &flow.retransmits)
+			fmt.Printf("# connection: %s\n", flow.lifecycle.describe(flow.initTimestamp))
+			fmt.Printf("# path: %s\n", &flow.path)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if f.ICMP != nil {
+			if err := flow.consumeICMP(f, selector); err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+		if fp, err := flow.consumePacket(f, selector); err == nil {
 			log.Println(fp.String())
 		} else {
 			log.Println(err)
 		}
 	}
-	return nil
 }
 
-// initTimestamp initial timestamp in microseconds
+// initTimestamp initial timestamp in nanoseconds
 // local is the side that initiates connection (syn).
 // remote is the other side of the connection (syn ack).
+// endpoints are set from the first local packet, later packets must match them.
 // inflight are the files that are sent from local to remote and are not yet acknowledged.
+// Sequence and ack numbers are 64 bit byte offsets from the initial sequence number, see seqUnwrapper.
+// highestAckNum is the highest ack number seen from the remote.
+// highestSentEnd is the highest expectedAckNum sent, data below it is retransmitted.
+// dupAcks is the number of duplicate acks since the ack number advanced.
+// lastSentTime is the time of the most recent local-to-remote segment with payload.
+// timestamps track TSvals sent from local to remote, for RTTFromTimestamps.
 // deliveredTime is time of the most recent ACK, as in BBR paper.
 // delivered is sum of bytes delivered, as in BBR paper.
+// firstSentTime is the send time of the most recently delivered packet, as in the delivery rate draft.
+// minRTT is the lowest RTT seen so far, rate samples over shorter intervals are discarded.
+// receiver is the state of the receiver-side estimation, for Download.
+// lifecycle is the state of the connection, from the handshake to close or reset.
+// path follows the ICMP errors about the packets of the flow.
+// mssUnknownWarned is set after warning that super-segments cannot be split, the warning is not repeated.
 type flow struct {
-	initTimestamp uint64
-	local         *flowDetails
-	remote        *flowDetails
-	inflight      []*flowPacket
-	stats         []*flowStat
-	deliveredTime uint64
-	delivered     uint32
-	cbAckInFlight func(*flowStat)
+	config           *Config
+	initTimestamp    uint64
+	local            *flowDetails
+	remote           *flowDetails
+	endpoints        endpoints
+	inflight         []*flowPacket
+	highestAckNum    uint64
+	highestSentEnd   uint64
+	dupAcks          int
+	lastSentTime     uint64
+	timestamps       tsTracker
+	rto              rtoEstimator
+	retransmits      retransmitTracker
+	cbEvent          func(*event)
+	deliveredTime    uint64
+	delivered        uint64
+	firstSentTime    uint64
+	minRTT           uint64
+	receiver         receiver
+	lifecycle        lifecycle
+	path             pathTracker
+	mssUnknownWarned bool
+	cbAckInFlight    func(*flowStat)
+	cbWarning        func(string)
 }
 
-// initSeqNum is initial sequence number.
+// initSeqNum is initial sequence number, seqs unwraps the sequence numbers relative to it.
+// synSeen tells if the details were taken from SYN, and so windowScale is known. hasWindowScale tells if the SYN
+// had the window scale option. mss is from the SYN, zero if not known. hasTimestamps tells if the SYN had the
+// timestamps option.
 type flowDetails struct {
-	ip         pcap.IPv4
-	initSeqNum pcap.SeqNum
+	ip             pcap.IP
+	port           uint16
+	initSeqNum     pcap.SeqNum
+	seqs           seqUnwrapper
+	synSeen        bool
+	hasWindowScale bool
+	windowScale    uint8
+	mss            uint16
+	hasTimestamps  bool
 }
 
 // flowPacket is a packet.Packet with flow context
@@ -55,11 +139,16 @@ type flowPacket struct {
 	relativeTimestamp uint64
 	packet            *packet.Packet
 	direction         flowPacketDirection
-	relativeSeqNum    pcap.SeqNum
-	relativeAckNum    pcap.SeqNum
-	expectedAckNum    pcap.SeqNum
+	relativeSeqNum    uint64
+	relativeAckNum    uint64
+	expectedAckNum    uint64
 	deliveredTime     uint64
-	delivered         uint32
+	delivered         uint64
+	firstSentTime     uint64
+	sacked            bool
+	// retransmission is set when the packet is retransmitted, retransmitTime is the time of the last retransmission.
+	retransmission *retransmission
+	retransmitTime uint64
 }
 
 type flowPacketDirection int
@@ -69,64 +158,149 @@ const (
 	remoteToLocal
 )
 
-func (f *flow) consumePacket(packet *packet.Packet, localIP, remoteIP *pcap.IPv4) (*flowPacket, error) {
-	if !((packet.IP.SourceIP() == *localIP && packet.IP.DestIP() == *remoteIP) ||
-		(packet.IP.SourceIP() == *remoteIP && packet.IP.DestIP() == *localIP)) {
+func (f *flow) consumePacket(packet *packet.Packet, selector *Selector) (*flowPacket, error) {
+	if packet.TCP == nil {
+		return nil, fmt.Errorf("Dropping %s > %s (%s, not TCP)", packet.IP.SourceIP(), packet.IP.DestIP(), pcap.ProtocolName(packet.Protocol()))
+	}
+	if packet.Checksum() == pcap.ChecksumBad {
+		return nil, fmt.Errorf("Dropping %s:%d > %s:%d (bad checksum)", packet.IP.SourceIP(), packet.TCP.SourcePort(), packet.IP.DestIP(), packet.TCP.DestPort())
+	}
+	if !f.lifecycle.reused && selector.matches(packet) && f.isNewInstance(packet) {
+		// Only the first connection is followed, a new one reusing the same tuple is ignored.
+		f.lifecycle.reused = true
+		msg := fmt.Sprintf("Connection %s, tuple reused by a new connection, which is not followed (use -a)", f.lifecycle.state)
+		log.Printf("Warning: %s", msg)
+		if f.cbWarning != nil {
+			f.cbWarning(msg)
+		}
+	}
+	if f.lifecycle.reused {
+		return nil, fmt.Errorf("Dropping %s:%d > %s:%d (connection %s, tuple reused)", packet.IP.SourceIP(), packet.TCP.SourcePort(), packet.IP.DestIP(), packet.TCP.DestPort(), f.lifecycle.state)
+	}
+	fp, err := f.trackPacket(packet, selector)
+	if err != nil {
+		return nil, err
+	}
+	f.updateLifecycle(fp)
+	return fp, nil
+}
+
+// trackPacket sets up the flow with the first packets, and then follows the data and the acks.
+func (f *flow) trackPacket(packet *packet.Packet, selector *Selector) (*flowPacket, error) {
+	if !selector.matches(packet) {
 		// Filter packets that surely do not belong to the flow.
-		return nil, fmt.Errorf("Dropping %s > %s (not in the flow)", packet.IP.SourceIP(), packet.IP.DestIP())
+		return nil, fmt.Errorf("Dropping %s:%d > %s:%d (not in the flow)", packet.IP.SourceIP(), packet.TCP.SourcePort(), packet.IP.DestIP(), packet.TCP.DestPort())
 	}
 
 	if f.local == nil && f.remote == nil {
 		// If has neither local or remote, treat the first packet as local packet.
-		if packet.IP.SourceIP() != *localIP {
-			return nil, fmt.Errorf("Dropping %s > %s (not local-to-remote)", packet.IP.SourceIP(), packet.IP.DestIP())
+		if !selector.isLocalToRemote(packet) {
+			return nil, fmt.Errorf("Dropping %s:%d > %s:%d (not local-to-remote)", packet.IP.SourceIP(), packet.TCP.SourcePort(), packet.IP.DestIP(), packet.TCP.DestPort())
 		}
 
 		f.initTimestamp = packet.Record.Timestamp()
-		f.local = newFlowDetailsFromSource(packet) // TODO Simplify, since local IP is known.
-		fp := f.newInitialFlowPacket(packet, localToRemote)
-		log.Printf("Initialize local: %s", fp)
-		return fp, nil
-	} else if f.local != nil && f.remote == nil {
-		// If has only local, either set remote (in case of remote-to-local packet), or update local (in case
-		// of local-to-remote packet).
-		if f.local.ip == packet.IP.SourceIP() {
-			f.local = newFlowDetailsFromSource(packet)
+		f.endpoints = newEndpointsFromLocalSource(packet)
+		f.local = newFlowDetailsFromSource(packet)
+		log.Printf("Following connection %s", f.endpoints)
+		if packet.TCP.IsSyn() || !packet.TCP.IsAck() {
+			f.timestamps.onSend(packet)
+			f.onLocalSyn(packet)
 			fp := f.newInitialFlowPacket(packet, localToRemote)
-			log.Printf("Update local: %s", fp)
+			log.Printf("Initialize local: %s", fp)
 			return fp, nil
+		}
+		// The capture started after the handshake, bootstrap the remote from the ack number.
+		f.remote = newFlowDetailsFromAck(packet)
+		log.Printf("Bootstrap local: %s, remote: %s", f.local, f.remote)
+		f.checkHandshake()
+	} else if !f.endpoints.isLocalToRemote(packet) && !f.endpoints.isRemoteToLocal(packet) {
+		// Other connection between the same hosts.
+		return nil, fmt.Errorf("Dropping %s:%d > %s:%d (not in the connection)", packet.IP.SourceIP(), packet.TCP.SourcePort(), packet.IP.DestIP(), packet.TCP.DestPort())
+	} else if f.remote == nil {
+		// If has only local, either set remote (in case of remote-to-local packet), or update local (in case
+		// of local-to-remote SYN, e.g. retransmitted).
+		if f.endpoints.isLocalToRemote(packet) {
+			if packet.TCP.IsSyn() || !packet.TCP.IsAck() {
+				f.local = newFlowDetailsFromSource(packet)
+				f.timestamps.onSend(packet)
+				f.onLocalSyn(packet)
+				fp := f.newInitialFlowPacket(packet, localToRemote)
+				log.Printf("Update local: %s", fp)
+				return fp, nil
+			}
+			// SYN-ACK was not captured, bootstrap the remote from the ack number.
+			f.remote = newFlowDetailsFromAck(packet)
+			log.Printf("Bootstrap remote: %s", f.remote)
+			f.checkHandshake()
 		} else {
 			f.remote = newFlowDetailsFromSource(packet)
-			fp := f.newInitialFlowPacket(packet, remoteToLocal)
-			log.Printf("Initialize remote: %s", fp)
-			return fp, nil
-		}
-	} else if f.local != nil && f.remote != nil {
-		flowPacket, err := f.createFlowPacket(packet)
-		if err != nil {
-			return nil, err
+			f.checkHandshake()
+			if packet.TCP.IsSyn() {
+				fp := f.newInitialFlowPacket(packet, remoteToLocal)
+				f.receiver.onSynAck(fp)
+				log.Printf("Initialize remote: %s", fp)
+				return fp, nil
+			}
+			// The capture started after the handshake, the remote is bootstrapped from the first packet.
+			log.Printf("Bootstrap remote: %s", f.remote)
 		}
-		// If has both local and remote, do the proper processing.
+	}
+
+	// Has both local and remote, do the proper processing.
+	flowPacket, err := f.createFlowPacket(packet)
+	if err != nil {
+		return nil, err
+	}
+	if f.config.Direction == Download {
 		if flowPacket.direction == localToRemote {
-			err := f.onSend(flowPacket)
-			if err != nil {
-				return nil, err
-			}
-		} else if flowPacket.direction == remoteToLocal && flowPacket.packet.TCP.IsAck() {
-			f.onAck(flowPacket)
+			f.timestamps.onSend(packet)
+			f.onReceiverAck(flowPacket)
 		} else {
-			panic("direction not set!")
+			f.onData(flowPacket)
+		}
+	} else if flowPacket.direction == localToRemote {
+		f.timestamps.onSend(packet)
+		err := f.onSend(flowPacket)
+		if err != nil {
+			return nil, err
 		}
-		return flowPacket, nil
+	} else if flowPacket.packet.TCP.IsAck() {
+		f.onAck(flowPacket)
+	}
+	return flowPacket, nil
+}
+
+// checkHandshake warns if the handshake was not captured, so the values taken from the SYNs are not known.
+func (f *flow) checkHandshake() {
+	if f.handshakeSeen() {
+		return
+	}
+	msg := fmt.Sprintf("handshake not captured (local SYN: %t, remote SYN: %t), window scale, MSS and SYN RTT are not known",
+		f.local.synSeen, f.remote.synSeen)
+	log.Printf("Warning: %s", msg)
+	if f.cbWarning != nil {
+		f.cbWarning(msg)
 	}
-	panic(fmt.Sprintf("BAD STATE, f.local=%+v, f.remote=%+v", f.local, f.remote))
 }
 
 // Packets sent are inflight until acknowledged. Only packets with payload are expected to be acknowledged (i.e. pure 'acks' with no payload do not count as inflight.)
+// Packets overlapping the data already sent are retransmissions, they are not added to inflight again. A segment
+// resent together with new data (repacketized) is split, only the new data goes to inflight.
 func (f *flow) onSend(p *flowPacket) error {
 	if p.packet.PayloadSize() == 0 {
 		return nil
 	}
+	if p.relativeSeqNum < f.highestSentEnd {
+		if p.expectedAckNum <= f.highestSentEnd {
+			f.onRetransmit(p)
+			return nil
+		}
+		resent, fresh := *p, *p
+		resent.expectedAckNum = f.highestSentEnd
+		fresh.relativeSeqNum = f.highestSentEnd
+		f.onRetransmit(&resent)
+		p = &fresh
+	}
 	// Assert that packets are sorted by expectedAckNum.
 	if len(f.inflight) > 0 {
 		lastInflight := f.inflight[len(f.inflight)-1]
@@ -134,44 +308,195 @@ func (f *flow) onSend(p *flowPacket) error {
 			return fmt.Errorf("Wrong order of expectedAckNum. last inflight %s, current %s", lastInflight, p)
 		}
 	}
-	p.delivered = f.delivered
-	p.deliveredTime = f.deliveredTime
-	f.inflight = append(f.inflight, p)
+	for _, segment := range f.splitSegment(p) {
+		f.onPacketSent(segment)
+		f.inflight = append(f.inflight, segment)
+	}
+	f.highestSentEnd = p.expectedAckNum
+	f.lastSentTime = p.sentTime()
 	return nil
 }
 
+// splitSegment splits a super-segment into segments of the MSS advertised by the remote, if SplitSegments is set.
+// If timestamps were negotiated, each segment carries the option, so it has that much less payload. The segments
+// share the packet, they differ only in the sequence numbers.
+func (f *flow) splitSegment(p *flowPacket) []*flowPacket {
+	if !f.config.SplitSegments {
+		return []*flowPacket{p}
+	}
+	mss := uint64(f.remote.mss)
+	if mss > timestampsOptionSize && f.local.hasTimestamps && f.remote.hasTimestamps {
+		mss -= timestampsOptionSize
+	}
+	if mss == 0 {
+		if p.packet.IsOversized() && !f.mssUnknownWarned {
+			f.mssUnknownWarned = true
+			msg := fmt.Sprintf("MSS not known, super-segment of %d bytes at seq %d not split", p.payloadSize(), p.relativeSeqNum)
+			log.Printf("Warning: %s", msg)
+			if f.cbWarning != nil {
+				f.cbWarning(msg)
+			}
+		}
+		return []*flowPacket{p}
+	}
+	if p.payloadSize() <= mss {
+		return []*flowPacket{p}
+	}
+	segments := []*flowPacket{}
+	for seq := p.relativeSeqNum; seq < p.expectedAckNum; seq += mss {
+		segment := *p
+		segment.relativeSeqNum = seq
+		segment.expectedAckNum = seq + mss
+		if segment.expectedAckNum > p.expectedAckNum {
+			segment.expectedAckNum = p.expectedAckNum
+		}
+		segments = append(segments, &segment)
+	}
+	log.Printf("Split %d bytes at seq=%d into %d segments of MSS %d", p.payloadSize(), p.relativeSeqNum, len(segments), mss)
+	return segments
+}
+
 func (f *flow) onAck(ack *flowPacket) {
-	sent, i, ok := f.findPacketSent(ack)
-	if !ok {
+	var tsRTT uint64
+	var tsOK bool
+	if ack.relativeAckNum > f.highestAckNum {
+		f.highestAckNum = ack.relativeAckNum
+		f.dupAcks = 0
+		tsRTT, tsOK = f.timestamps.rttFor(ack.packet)
+	} else if f.isDupAck(ack) {
+		f.dupAcks++
+	}
+	f.detectDSACK(ack)
+
+	now := ack.packet.Record.Timestamp()
+	rs := &rateSample{}
+	// Packets reported in SACK blocks are delivered, even if not cumulatively acknowledged yet.
+	f.markSacked(ack, rs, now)
+	// Credit all the packets covered by the cumulative ack, not only the one matching the ack number exactly.
+	acked := f.countPacketsAcked(ack)
+	for _, p := range f.inflight[:acked] {
+		f.detectEifel(ack, p)
+		if !p.sacked {
+			f.onPacketDelivered(rs, p, now)
+		}
+	}
+	f.pruneInflight(acked)
+	sent := rs.packet
+	if sent == nil {
+		return
+	}
+
+	// Karn's algorithm: RTT of retransmitted packets is ambiguous, unless timestamps are used.
+	rttMethod := RTTFromSeq
+	rtt := now - sent.sentTime()
+	rttOK := !sent.isRetransmitted()
+	if f.config.RTTMethod == RTTFromTimestamps && tsOK {
+		rtt = tsRTT
+		rttMethod = RTTFromTimestamps
+		rttOK = true
+	}
+	if !rttOK {
+		log.Printf("Discarding sample for ackNum=%d, rtt of retransmitted packet is ambiguous", ack.relativeAckNum)
 		return
 	}
+	f.updateRTT(rtt)
 
-	rtt := ack.packet.Record.Timestamp() - sent.packet.Record.Timestamp()
-	f.delivered += uint32(sent.packet.PayloadSize())
-	f.deliveredTime = ack.packet.Record.Timestamp()
-	deliveryRate := 8 * usecInSec * float32(f.delivered-sent.delivered) / float32(f.deliveredTime-sent.deliveredTime)
+	deliveryRate, ok := f.deliveryRate(rs)
+	if !ok {
+		log.Printf("Discarding rate sample for ackNum=%d, interval shorter than min rtt", ack.relativeAckNum)
+		return
+	}
 
 	stat := &flowStat{
-		// Note that relativeTimestampUSec is the timestmap of the ACK-ing packet, not the original packet.
-		relativeTimestampUSec: ack.relativeTimestamp,
-		rttUSec:               rtt,
+		// Note that relativeTimestampNSec is the timestmap of the ACK-ing packet, not the original packet.
+		relativeTimestampNSec: ack.relativeTimestamp,
+		rttNSec:               rtt,
 		deliveryRateBPS:       uint32(deliveryRate),
-		sentWindowSize:        sent.packet.TCP.WindowSize(),
-		ackWindowSize:         ack.packet.TCP.WindowSize(),
+		sentWindowSize:        f.scaledWindow(sent),
+		ackWindowSize:         f.scaledWindow(ack),
+		windowKnown:           f.isWindowScaleKnown(),
+		rttMethod:             rttMethod,
+		estimate:              Upload.estimate(),
+		pathMTU:               f.path.mtu,
+		pathErrors:            f.path.errors,
+	}
+	// The ack of FIN is one past the data sent.
+	if f.highestSentEnd > f.highestAckNum {
+		stat.windowUsed = windowUsed(f.highestSentEnd-f.highestAckNum, stat.ackWindowSize)
 	}
 	log.Printf("Got ack for inflight packet: ackNum=%d, rate=%.0fkb/s, %s", ack.relativeAckNum, deliveryRate/1000, stat)
-	fmt.Println(stat.CSVString()) // Eventually remove it from here to a delegated callback
-	f.stats = append(f.stats, stat)
-	f.inflight = f.inflight[i+1:]
+	if f.cbAckInFlight != nil {
+		f.cbAckInFlight(stat)
+	}
 }
 
-func (f *flow) findPacketSent(ack *flowPacket) (sent *flowPacket, inflightIndex int, ok bool) {
-	for i, g := range f.inflight {
-		if ack.relativeAckNum == g.expectedAckNum {
-			return g, i, true
-		}
+// onLocalSyn remembers when local sent SYN, for the handshake RTT.
+func (f *flow) onLocalSyn(packet *packet.Packet) {
+	if packet.TCP.IsSyn() && !packet.TCP.IsAck() {
+		f.receiver.synTime = packet.Record.Timestamp()
+		f.receiver.synSent = true
+	}
+}
+
+// isDataFromSender tells if the packet goes from the data sender to the data receiver, as set by the direction.
+func (f *flow) isDataFromSender(packet *packet.Packet) bool {
+	if f.config.Direction == Download {
+		return f.endpoints.isRemoteToLocal(packet)
+	}
+	return f.endpoints.isLocalToRemote(packet)
+}
+
+// isDupAck tells if the ack is a duplicate ack, i.e. a pure ack that does not advance the ack number while there
+// is data in flight.
+func (f *flow) isDupAck(ack *flowPacket) bool {
+	return ack.relativeAckNum == f.highestAckNum && ack.packet.PayloadSize() == 0 &&
+		!ack.packet.TCP.IsSyn() && !ack.packet.TCP.IsFin() && len(f.inflight) > 0
+}
+
+// pruneInflight drops first n inflight packets. The pointers are cleared so the acknowledged packets can be
+// garbage collected, and memory stays proportional to the inflight window.
+func (f *flow) pruneInflight(n int) {
+	for k := 0; k < n; k++ {
+		f.inflight[k] = nil
+	}
+	f.inflight = f.inflight[n:]
+}
+
+// handshakeSeen tells if both SYNs were captured. Otherwise the capture started mid-connection, and the relative
+// sequence numbers are bootstrapped from the first packets.
+func (f *flow) handshakeSeen() bool {
+	return f.local != nil && f.remote != nil && f.local.synSeen && f.remote.synSeen
+}
+
+// isWindowScaleKnown tells if both SYNs were captured, so it is known whether and how windows are scaled.
+func (f *flow) isWindowScaleKnown() bool {
+	return f.handshakeSeen()
+}
+
+// scaledWindow returns the window advertised by the packet in bytes, as in RFC 7323. Windows are scaled only if
+// both sides sent the window scale option, and never in SYN segments. If the handshake was not captured, the raw
+// window is returned.
+func (f *flow) scaledWindow(p *flowPacket) uint32 {
+	window := uint32(p.packet.TCP.WindowSize())
+	if !f.isWindowScaleKnown() || p.packet.TCP.IsSyn() {
+		return window
+	}
+	if !f.local.hasWindowScale || !f.remote.hasWindowScale {
+		return window
+	}
+	if p.direction == localToRemote {
+		return window << f.local.windowScale
+	}
+	return window << f.remote.windowScale
+}
+
+// countPacketsAcked returns the number of inflight packets acknowledged by the ack. Inflight packets are sorted
+// by expectedAckNum, so these are the first packets.
+func (f *flow) countPacketsAcked(ack *flowPacket) int {
+	n := 0
+	for ; n < len(f.inflight) && f.inflight[n].expectedAckNum <= ack.relativeAckNum; n++ {
 	}
-	return nil, -1, false
+	return n
 }
 
 func (f *flow) newInitialFlowPacket(packet *packet.Packet, direction flowPacketDirection) *flowPacket {
@@ -197,15 +522,14 @@ func (f *flow) createFlowPacket(packet *packet.Packet) (*flowPacket, error) {
 
 	if f.isLocalToRemote(packet) {
 		flowPacket.direction = localToRemote
-		flowPacket.relativeSeqNum = packet.TCP.SeqNum().RelativeTo(f.local.initSeqNum)
-		flowPacket.relativeAckNum = packet.TCP.AckNum().RelativeTo(f.remote.initSeqNum)
-		// FIXME: handle next syn at integer boundaries gracefully.
-		flowPacket.expectedAckNum = flowPacket.relativeSeqNum.ExpectedForPayload(packet.PayloadSize())
+		flowPacket.relativeSeqNum = f.local.relative(packet.TCP.SeqNum())
+		flowPacket.relativeAckNum = f.remote.relative(packet.TCP.AckNum())
+		flowPacket.expectedAckNum = flowPacket.relativeSeqNum + uint64(packet.PayloadSize())
 	} else if f.isRemoteToLocal(packet) {
 		flowPacket.direction = remoteToLocal
-		flowPacket.relativeSeqNum = packet.TCP.SeqNum().RelativeTo(f.remote.initSeqNum)
-		flowPacket.relativeAckNum = packet.TCP.AckNum().RelativeTo(f.local.initSeqNum)
-		flowPacket.expectedAckNum = flowPacket.relativeSeqNum.ExpectedForPayload(packet.PayloadSize())
+		flowPacket.relativeSeqNum = f.remote.relative(packet.TCP.SeqNum())
+		flowPacket.relativeAckNum = f.local.relative(packet.TCP.AckNum())
+		flowPacket.expectedAckNum = flowPacket.relativeSeqNum + uint64(packet.PayloadSize())
 	} else {
 		return nil, fmt.Errorf("Unknown direction! %s", packet)
 	}
@@ -213,27 +537,44 @@ func (f *flow) createFlowPacket(packet *packet.Packet) (*flowPacket, error) {
 	return flowPacket, nil
 }
 
+// sentTime is the capture timestamp of the last transmission of the packet, in nanoseconds.
+func (p *flowPacket) sentTime() uint64 {
+	if p.retransmitTime != 0 {
+		return p.retransmitTime
+	}
+	return p.packet.Record.Timestamp()
+}
+
+// payloadSize is the size of the payload in the sequence space, for a split segment it is less than the packet payload.
+func (p *flowPacket) payloadSize() uint64 {
+	return p.expectedAckNum - p.relativeSeqNum
+}
+
+func (p *flowPacket) isRetransmitted() bool {
+	return p.retransmission != nil
+}
+
 func (f *flow) getRelativeTimestamp(packet *packet.Packet) uint64 {
 	return packet.Record.Timestamp() - f.initTimestamp
 }
 
 // isLocalToRemote indicates if a packet represents a packet going from local to remote.
 func (f *flow) isLocalToRemote(packet *packet.Packet) bool {
-	return f.local.ip == packet.IP.SourceIP() && f.remote.ip == packet.IP.DestIP()
+	return f.endpoints.isLocalToRemote(packet)
 }
 
 // isRemoteToLocal indicates if a packet represents a packet going from remote to local.
 func (f *flow) isRemoteToLocal(packet *packet.Packet) bool {
-	return f.remote.ip == packet.IP.SourceIP() && f.local.ip == packet.IP.DestIP()
+	return f.endpoints.isRemoteToLocal(packet)
 }
 
 func (p *flowPacket) String() string {
-	msg := fmt.Sprintf("%d", p.relativeTimestamp)
+	msg := fmt.Sprintf("%d", p.relativeTimestamp/nsecInUsec)
 
 	if p.direction == localToRemote {
-		msg += fmt.Sprintf(" %s >  %s", p.packet.IP.SourceIP(), p.packet.IP.DestIP())
+		msg += fmt.Sprintf(" %s:%d >  %s:%d", p.packet.IP.SourceIP(), p.packet.TCP.SourcePort(), p.packet.IP.DestIP(), p.packet.TCP.DestPort())
 	} else if p.direction == remoteToLocal {
-		msg += fmt.Sprintf(" %s  < %s", p.packet.IP.DestIP(), p.packet.IP.SourceIP())
+		msg += fmt.Sprintf(" %s:%d  < %s:%d", p.packet.IP.DestIP(), p.packet.TCP.DestPort(), p.packet.IP.SourceIP(), p.packet.TCP.SourcePort())
 	}
 	if p.packet.TCP.IsSyn() {
 		msg += " syn"
@@ -241,36 +582,91 @@ func (p *flowPacket) String() string {
 	if p.packet.TCP.IsAck() {
 		msg += " ack"
 	}
+	if p.packet.TCP.IsFin() {
+		msg += " fin"
+	}
+	if p.packet.TCP.IsRst() {
+		msg += " rst"
+	}
 
 	msg += fmt.Sprintf(" %d. seq %d (exp %d) ack %d", p.packet.PayloadSize(), p.relativeSeqNum, p.expectedAckNum, p.relativeAckNum)
 	return msg
 }
 
 // newFlowDetailsFromSource creates *flowDetails from source of the packet (that is, not from destination).
+// If the packet is not SYN, the initial sequence number is bootstrapped, so the first byte seen is at offset 1 as
+// if it followed SYN.
 func newFlowDetailsFromSource(packet *packet.Packet) *flowDetails {
+	options := packet.TCP.Options()
+	isSyn := packet.TCP.IsSyn()
+	initSeqNum := packet.TCP.SeqNum()
+	if !isSyn {
+		initSeqNum = initSeqNum.Add(math.MaxUint32)
+	}
+	details := &flowDetails{
+		ip:             packet.IP.SourceIP(),
+		port:           packet.TCP.SourcePort(),
+		initSeqNum:     initSeqNum,
+		seqs:           seqUnwrapper{initSeqNum: initSeqNum},
+		synSeen:        isSyn,
+		hasWindowScale: isSyn && options.HasWindowScale,
+		windowScale:    options.WindowScale,
+		hasTimestamps:  isSyn && options.HasTimestamps,
+	}
+	if isSyn && options.HasMSS {
+		details.mss = options.MSS
+	}
+	return details
+}
+
+// newFlowDetailsFromAck bootstraps *flowDetails of the destination of the packet, from its ack number, when the
+// destination did not send anything yet. The handshake was not seen, so window scale and MSS are not known.
+func newFlowDetailsFromAck(packet *packet.Packet) *flowDetails {
+	initSeqNum := packet.TCP.AckNum().Add(math.MaxUint32)
 	return &flowDetails{
-		ip:         packet.IP.SourceIP(),
-		initSeqNum: packet.TCP.SeqNum(),
+		ip:         packet.IP.DestIP(),
+		port:       packet.TCP.DestPort(),
+		initSeqNum: initSeqNum,
+		seqs:       seqUnwrapper{initSeqNum: initSeqNum},
 	}
 }
 
+// relative returns the sequence number as a 64 bit offset from the initial sequence number.
+func (d *flowDetails) relative(s pcap.SeqNum) uint64 {
+	return d.seqs.unwrap(s)
+}
+
 func (d *flowDetails) String() string {
-	return fmt.Sprintf("%s, seq: %d", d.ip, d.initSeqNum)
+	return fmt.Sprintf("%s:%d, seq: %d, syn: %t, wscale: %t %d, mss: %d", d.ip, d.port, d.initSeqNum, d.synSeen, d.hasWindowScale, d.windowScale, d.mss)
 }
 
 // Single data point for flow statistics.
 type flowStat struct {
-	relativeTimestampUSec uint64
-	rttUSec               uint64
+	relativeTimestampNSec uint64
+	rttNSec               uint64
 	deliveryRateBPS       uint32
-	sentWindowSize        uint16
-	ackWindowSize         uint16
+	sentWindowSize        uint32
+	ackWindowSize         uint32
+	windowKnown           bool
+	rttMethod             RTTMethod
+	estimate              string
+	windowUsed            float64
+	pathMTU               uint32
+	pathErrors            int
 }
 
 func (s *flowStat) String() string {
-	return fmt.Sprintf("ts: %d msec, rtt: %d msec, win: %d, %d", s.relativeTimestampUSec/1000, s.rttUSec/1000, s.sentWindowSize, s.ackWindowSize)
+	return fmt.Sprintf("ts: %d msec, rtt: %d msec, win: %d, %d", s.relativeTimestampNSec/nsecInMsec, s.rttNSec/nsecInMsec, s.sentWindowSize, s.ackWindowSize)
 }
 
 func (s *flowStat) CSVString() string {
-	return fmt.Sprintf("%d\t%d\t%d\t%d", s.deliveryRateBPS, s.rttUSec, s.sentWindowSize, s.ackWindowSize)
+	// RTT is printed in microseconds with fractional part, so sub-microsecond precision is not lost.
+	return fmt.Sprintf("%d\t%.3f\t%d\t%d\t%d\t%s\t%s\t%.3f\t%d\t%d", s.deliveryRateBPS, float64(s.rttNSec)/nsecInUsec, s.sentWindowSize, s.ackWindowSize, boolToInt(s.windowKnown), s.rttMethod, s.estimate, s.windowUsed, s.pathMTU, s.pathErrors)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
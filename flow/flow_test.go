@@ -0,0 +1,479 @@
+package flow
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"jakub-m/bdp/packet"
+	"jakub-m/bdp/pcap"
+	"jakub-m/bdp/pcap/pcaptest"
+	"reflect"
+	"testing"
+)
+
+const (
+	testFlagFin = 0x01
+	testFlagSyn = 0x02
+	testFlagAck = 0x10
+	testLocalIP = "10.0.0.1"
+	testRemote  = "10.0.0.2"
+)
+
+// testSegment is a TCP segment of a test capture between local 10.0.0.1:40000 (or localPort, if set) and remote
+// 10.0.0.2:443. usec is the capture time. options are raw TCP options, padded to 4 bytes by the caller. gso makes it
+// a GSO super-segment as captured on the sending host, with zero TotalLength and only the headers captured.
+type testSegment struct {
+	usec      uint32
+	fromLocal bool
+	flags     uint16
+	seq       uint32
+	ack       uint32
+	payload   int
+	options   []byte
+	gso       bool
+	localPort uint16
+}
+
+// buildTestCapture writes the segments as an Ethernet pcap file.
+func buildTestCapture(segments []testSegment) *bytes.Buffer {
+	records := []pcaptest.Record{}
+	for _, s := range segments {
+		record := pcaptest.RecordAtUsec(s.usec, buildTestFrame(s))
+		if s.gso {
+			record.CapLen = len(record.Data) - s.payload
+		}
+		records = append(records, record)
+	}
+	return pcaptest.Write(binary.LittleEndian, pcaptest.MagicMicro, records...)
+}
+
+func buildTestFrame(s testSegment) []byte {
+	src, dst := []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}
+	srcPort, dstPort := uint16(40000), uint16(443)
+	if s.localPort != 0 {
+		srcPort = s.localPort
+	}
+	if !s.fromLocal {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+	}
+	tcp := pcaptest.TCP(srcPort, dstPort, s.seq, s.ack, s.flags, s.options, s.payload)
+	totalLength := uint16(20 + len(tcp))
+	if s.gso {
+		totalLength = 0
+	}
+	return pcaptest.Ethernet(pcaptest.IPv4(totalLength, 1, 0x4000, 6, src, dst, tcp))
+}
+
+// readTestPackets decodes the test capture.
+func readTestPackets(t *testing.T, segments []testSegment) []*packet.Packet {
+	return decodeTestCapture(t, buildTestCapture(segments))
+}
+
+func decodeTestCapture(t *testing.T, capture *bytes.Buffer) []*packet.Packet {
+	source, err := packet.NewSource(capture, packet.ChecksumOff, func(err error) bool {
+		t.Fatal(err)
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := []*packet.Packet{}
+	for {
+		p, err := source.Next()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, p)
+	}
+}
+
+// testFlow feeds the segments to a new upload flow, and returns the flow and the rate samples it produced.
+func testFlow(t *testing.T, config *Config, segments []testSegment) (*flow, []*flowStat) {
+	localIP, _ := pcap.IPFromString(testLocalIP)
+	remoteIP, _ := pcap.IPFromString(testRemote)
+	selector := &Selector{LocalIP: localIP, RemoteIP: remoteIP}
+	stats := []*flowStat{}
+	f := &flow{
+		config: config,
+		cbAckInFlight: func(stat *flowStat) {
+			stats = append(stats, stat)
+		},
+	}
+	for _, p := range readTestPackets(t, segments) {
+		if _, err := f.consumePacket(p, selector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f, stats
+}
+
+// handshake is SYN, SYN-ACK and ACK with local ISN 1000 and remote ISN 5000, the remote advertises MSS 1000.
+func handshake() []testSegment {
+	return handshakeWithISN(1000)
+}
+
+// handshakeWithISN is handshake with the given local ISN.
+func handshakeWithISN(isn uint32) []testSegment {
+	return []testSegment{
+		{usec: 0, fromLocal: true, flags: testFlagSyn, seq: isn},
+		{usec: 20000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 5000, ack: isn + 1, options: []byte{2, 4, 0x03, 0xE8}},
+		{usec: 20010, fromLocal: true, flags: testFlagAck, seq: isn + 1, ack: 5001},
+	}
+}
+
+// sackOption is SACK option with a single block, with the NOP padding.
+func sackOption(left, right uint32) []byte {
+	option := []byte{1, 1, 5, 10}
+	option = binary.BigEndian.AppendUint32(option, left)
+	return binary.BigEndian.AppendUint32(option, right)
+}
+
+// tsOption is the timestamps option, with the NOP padding.
+func tsOption(tsVal, tsEcr uint32) []byte {
+	option := []byte{1, 1, 8, 10}
+	option = binary.BigEndian.AppendUint32(option, tsVal)
+	return binary.BigEndian.AppendUint32(option, tsEcr)
+}
+
+func assertEqual(t *testing.T, actual, expected interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v (%T), got %v (%T)", expected, expected, actual, actual)
+	}
+}
+
+func TestOnSend_RetransmissionWithNewData(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 30100, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1000},
+		// Repacketized after RTO: the second segment is resent together with new data.
+		testSegment{usec: 1500000, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 2000},
+		testSegment{usec: 1500100, fromLocal: true, flags: testFlagAck, seq: 4001, ack: 5001, payload: 1000},
+		testSegment{usec: 1520200, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 5001},
+	)
+	f, _ := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(4000))
+	assertEqual(t, f.highestSentEnd, uint64(4001))
+	assertEqual(t, len(f.inflight), 0)
+	assertEqual(t, f.retransmits.total(), 1)
+	assertEqual(t, f.retransmits.counts[rtoRetransmit], 1)
+	r := f.retransmits.recent[0]
+	assertEqual(t, r.seqNum, uint64(1001))
+	assertEqual(t, r.endSeqNum, uint64(2001))
+}
+
+func TestOnAck_DelayedAckCoversTwoSegments(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 30100, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1000},
+		testSegment{usec: 50100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 3001},
+	)
+	f, stats := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(2000))
+	assertEqual(t, len(f.inflight), 0)
+	assertEqual(t, len(stats), 1)
+	// RTT of the most recently sent segment, rate over the ack interval since the first segment was sent.
+	assertEqual(t, stats[0].rttNSec, uint64(20000*nsecInUsec))
+	assertEqual(t, stats[0].deliveryRateBPS, uint32(8*2000*nsecInSec/(20100*nsecInUsec)))
+}
+
+func TestMarkSacked_CreditedOnce(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 30100, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1000},
+		testSegment{usec: 30200, fromLocal: true, flags: testFlagAck, seq: 3001, ack: 5001, payload: 1000},
+		// The first segment is lost, the other two are SACKed.
+		testSegment{usec: 50100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1001, options: sackOption(2001, 3001)},
+		testSegment{usec: 50200, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1001, options: sackOption(2001, 4001)},
+		testSegment{usec: 50300, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 70300, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 4001},
+	)
+	f, _ := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(3000))
+	assertEqual(t, len(f.inflight), 0)
+}
+
+func TestMarkSacked_DeliveredBeforeCumulativeAck(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 30100, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1000},
+		testSegment{usec: 50100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1001, options: sackOption(2001, 3001)},
+	)
+	f, _ := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(1000))
+	assertEqual(t, len(f.inflight), 2)
+	assertEqual(t, f.inflight[1].sacked, true)
+}
+
+func TestFlow_LongerThan4GiB(t *testing.T) {
+	isn := uint32(0xFFFFFF00)
+	segments := handshakeWithISN(isn)
+	usec := uint32(30000)
+	// A sparse transfer, one segment per GiB, each acked.
+	for o := uint64(1); o < 5*gib; o += gib {
+		seq := isn + uint32(o)
+		segments = append(segments,
+			testSegment{usec: usec, fromLocal: true, flags: testFlagAck, seq: seq, ack: 5001, payload: 1000},
+			testSegment{usec: usec + 20000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: seq + 1000},
+		)
+		usec += 30000
+	}
+	offset := uint64(5*gib + 1)
+	seq := isn + uint32(offset)
+	segments = append(segments,
+		testSegment{usec: usec, fromLocal: true, flags: testFlagAck, seq: seq, ack: 5001, payload: 1000},
+		testSegment{usec: usec + 100, fromLocal: true, flags: testFlagAck, seq: seq + 1000, ack: 5001, payload: 1000},
+		// The first segment is lost, the second is SACKed.
+		testSegment{usec: usec + 20100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: seq, options: sackOption(seq+1000, seq+2000)},
+		// Late ack from 1 GiB earlier.
+		testSegment{usec: usec + 20200, fromLocal: false, flags: testFlagAck, seq: 5001, ack: seq - gib + 1000},
+		testSegment{usec: usec + 20300, fromLocal: true, flags: testFlagAck, seq: seq, ack: 5001, payload: 1000},
+		testSegment{usec: usec + 40300, fromLocal: false, flags: testFlagAck, seq: 5001, ack: seq + 2000},
+	)
+	f, _ := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(7000))
+	assertEqual(t, f.highestSentEnd, offset+2000)
+	assertEqual(t, f.highestAckNum, offset+2000)
+	assertEqual(t, len(f.inflight), 0)
+}
+
+func TestFlow_InitSeqNumNearWraparound(t *testing.T) {
+	isn := uint32(0xFFFFFFFF - 1500)
+	segments := append(handshakeWithISN(isn),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: isn + 1, ack: 5001, payload: 1000},
+		// The raw sequence numbers wrap within the second segment.
+		testSegment{usec: 30100, fromLocal: true, flags: testFlagAck, seq: isn + 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 30200, fromLocal: true, flags: testFlagAck, seq: isn + 2001, ack: 5001, payload: 1000},
+		testSegment{usec: 50100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: isn + 1, options: sackOption(isn+1001, isn+3001)},
+		testSegment{usec: 50300, fromLocal: true, flags: testFlagAck, seq: isn + 1, ack: 5001, payload: 1000},
+		testSegment{usec: 70300, fromLocal: false, flags: testFlagAck, seq: 5001, ack: isn + 3001},
+	)
+	f, _ := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(3000))
+	assertEqual(t, f.highestAckNum, uint64(3001))
+	assertEqual(t, len(f.inflight), 0)
+}
+
+func TestConsumePacket_NewInstanceAfterFin(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		testSegment{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+		// Half-closed by the local side, the FIN is not acked.
+		testSegment{usec: 60000, fromLocal: true, flags: testFlagFin | testFlagAck, seq: 2001, ack: 5001},
+		// The old SYN, retransmitted, is not a new instance.
+		testSegment{usec: 70000, fromLocal: true, flags: testFlagSyn, seq: 1000},
+		testSegment{usec: 80000, fromLocal: true, flags: testFlagSyn, seq: 90000},
+		testSegment{usec: 100000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 7000, ack: 90001},
+	)
+	localIP, _ := pcap.IPFromString(testLocalIP)
+	remoteIP, _ := pcap.IPFromString(testRemote)
+	selector := &Selector{LocalIP: localIP, RemoteIP: remoteIP}
+	warnings := []string{}
+	f := &flow{
+		config: &Config{},
+		cbWarning: func(msg string) {
+			warnings = append(warnings, msg)
+		},
+	}
+	packets := readTestPackets(t, segments)
+	for i, p := range packets {
+		_, err := f.consumePacket(p, selector)
+		assertEqual(t, err != nil, i >= len(packets)-2)
+	}
+	assertEqual(t, f.lifecycle.reused, true)
+	assertEqual(t, f.lifecycle.state, stateHalfClosed)
+	assertEqual(t, len(warnings), 1)
+	assertEqual(t, f.delivered, uint64(1000))
+}
+
+func TestSplitSegment_SuperSegment(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 2500, gso: true},
+		// The receiver acks the segments of MSS as they arrive.
+		testSegment{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+		testSegment{usec: 50100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 3501},
+	)
+	f, stats := testFlow(t, &Config{SplitSegments: true}, segments)
+	assertEqual(t, f.delivered, uint64(2500))
+	assertEqual(t, f.highestSentEnd, uint64(2501))
+	assertEqual(t, len(f.inflight), 0)
+	assertEqual(t, len(stats), 2)
+	assertEqual(t, stats[0].rttNSec, uint64(20000*nsecInUsec))
+	assertEqual(t, stats[1].rttNSec, uint64(20100*nsecInUsec))
+}
+
+func TestSplitSegment_NotSplitByDefault(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 2500, gso: true},
+		testSegment{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+	)
+	f, stats := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(0))
+	assertEqual(t, len(f.inflight), 1)
+	assertEqual(t, f.inflight[0].payloadSize(), uint64(2500))
+	assertEqual(t, len(stats), 0)
+}
+
+func TestOnAck_FinWithData(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagFin | testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		// FIN takes one sequence number past the data.
+		testSegment{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2002},
+	)
+	f, stats := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.delivered, uint64(1000))
+	assertEqual(t, len(stats), 1)
+	assertEqual(t, stats[0].windowUsed, float64(0))
+}
+
+func TestSplitSegment_TimestampsOverhead(t *testing.T) {
+	// MSS 1012, each segment carries the timestamps option, so it has 1000 bytes of payload.
+	segments := []testSegment{
+		{usec: 0, fromLocal: true, flags: testFlagSyn, seq: 1000, options: tsOption(1, 0)},
+		{usec: 20000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 5000, ack: 1001, options: append([]byte{2, 4, 0x03, 0xF4}, tsOption(7, 1)...)},
+		{usec: 20010, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, options: tsOption(2, 7)},
+		{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 2500, gso: true, options: tsOption(3, 7)},
+		{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001, options: tsOption(8, 3)},
+	}
+	f, stats := testFlow(t, &Config{SplitSegments: true}, segments)
+	assertEqual(t, f.delivered, uint64(1000))
+	assertEqual(t, len(f.inflight), 2)
+	assertEqual(t, f.inflight[0].payloadSize(), uint64(1000))
+	assertEqual(t, f.inflight[1].payloadSize(), uint64(500))
+	assertEqual(t, len(stats), 1)
+}
+
+// midConnectionFlow feeds the segments to a new upload flow, and returns the flow, the flow packets (nil for the
+// dropped packets), the rate samples and the warnings.
+func midConnectionFlow(t *testing.T, segments []testSegment) (*flow, []*flowPacket, []*flowStat, []string) {
+	localIP, _ := pcap.IPFromString(testLocalIP)
+	remoteIP, _ := pcap.IPFromString(testRemote)
+	selector := &Selector{LocalIP: localIP, RemoteIP: remoteIP}
+	stats := []*flowStat{}
+	warnings := []string{}
+	f := &flow{
+		config: &Config{},
+		cbAckInFlight: func(stat *flowStat) {
+			stats = append(stats, stat)
+		},
+		cbWarning: func(msg string) {
+			warnings = append(warnings, msg)
+		},
+	}
+	flowPackets := []*flowPacket{}
+	for _, p := range readTestPackets(t, segments) {
+		fp, _ := f.consumePacket(p, selector)
+		flowPackets = append(flowPackets, fp)
+	}
+	return f, flowPackets, stats, warnings
+}
+
+func TestTrackPacket_StartsWithLocalData(t *testing.T) {
+	f, flowPackets, stats, warnings := midConnectionFlow(t, []testSegment{
+		{usec: 0, fromLocal: true, flags: testFlagAck, seq: 700000, ack: 900000, payload: 1000},
+		{usec: 100, fromLocal: true, flags: testFlagAck, seq: 701000, ack: 900000, payload: 1000},
+		{usec: 20000, fromLocal: false, flags: testFlagAck, seq: 900000, ack: 701000},
+		{usec: 20100, fromLocal: false, flags: testFlagAck, seq: 900000, ack: 702000},
+	})
+	// The first byte seen is at offset 1, as if it followed SYN.
+	assertEqual(t, flowPackets[0].relativeSeqNum, uint64(1))
+	assertEqual(t, flowPackets[0].expectedAckNum, uint64(1001))
+	assertEqual(t, flowPackets[0].relativeAckNum, uint64(1))
+	assertEqual(t, flowPackets[1].relativeSeqNum, uint64(1001))
+	assertEqual(t, flowPackets[2].relativeSeqNum, uint64(1))
+	assertEqual(t, flowPackets[2].relativeAckNum, uint64(1001))
+	assertEqual(t, f.handshakeSeen(), false)
+	assertEqual(t, len(warnings), 1)
+	assertEqual(t, f.delivered, uint64(2000))
+	assertEqual(t, len(stats), 2)
+	assertEqual(t, stats[0].rttNSec, uint64(20000*nsecInUsec))
+	assertEqual(t, stats[0].windowKnown, false)
+	assertEqual(t, stats[0].ackWindowSize, uint32(65535))
+}
+
+func TestTrackPacket_StartsWithRemoteAck(t *testing.T) {
+	f, flowPackets, stats, warnings := midConnectionFlow(t, []testSegment{
+		// The flow starts with a local packet, the remote ack before it is dropped.
+		{usec: 0, fromLocal: false, flags: testFlagAck, seq: 900000, ack: 700000},
+		{usec: 100, fromLocal: true, flags: testFlagAck, seq: 700000, ack: 900000, payload: 1000},
+		{usec: 20100, fromLocal: false, flags: testFlagAck, seq: 900000, ack: 701000},
+	})
+	assertEqual(t, flowPackets[0], (*flowPacket)(nil))
+	assertEqual(t, flowPackets[1].relativeSeqNum, uint64(1))
+	assertEqual(t, flowPackets[2].relativeAckNum, uint64(1001))
+	assertEqual(t, f.initTimestamp, uint64(100*nsecInUsec))
+	assertEqual(t, len(warnings), 1)
+	assertEqual(t, len(stats), 1)
+	assertEqual(t, stats[0].rttNSec, uint64(20000*nsecInUsec))
+	assertEqual(t, stats[0].windowKnown, false)
+}
+
+func TestTrackPacket_SynAckNotCaptured(t *testing.T) {
+	f, flowPackets, stats, warnings := midConnectionFlow(t, []testSegment{
+		{usec: 0, fromLocal: true, flags: testFlagSyn, seq: 1000},
+		{usec: 20010, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		{usec: 40010, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+	})
+	assertEqual(t, flowPackets[1].relativeSeqNum, uint64(1))
+	assertEqual(t, flowPackets[1].relativeAckNum, uint64(1))
+	assertEqual(t, f.local.synSeen, true)
+	assertEqual(t, f.remote.synSeen, false)
+	assertEqual(t, len(warnings), 1)
+	assertEqual(t, len(stats), 1)
+	assertEqual(t, stats[0].windowKnown, false)
+}
+
+// windowScaleFlow runs a transfer of one segment after a handshake with the given SYN options, and returns the
+// rate sample.
+func windowScaleFlow(t *testing.T, localSynOptions, remoteSynOptions []byte) (*flow, *flowStat) {
+	segments := []testSegment{
+		{usec: 0, fromLocal: true, flags: testFlagSyn, seq: 1000, options: localSynOptions},
+		{usec: 20000, fromLocal: false, flags: testFlagSyn | testFlagAck, seq: 5000, ack: 1001, options: remoteSynOptions},
+		{usec: 20010, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001},
+		{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+	}
+	f, stats := testFlow(t, &Config{}, segments)
+	assertEqual(t, len(stats), 1)
+	return f, stats[0]
+}
+
+func TestScaledWindow_BothSides(t *testing.T) {
+	f, stat := windowScaleFlow(t, []byte{1, 3, 3, 7}, []byte{1, 3, 3, 8})
+	assertEqual(t, f.isWindowScaleKnown(), true)
+	assertEqual(t, stat.windowKnown, true)
+	assertEqual(t, stat.sentWindowSize, uint32(65535<<7))
+	assertEqual(t, stat.ackWindowSize, uint32(65535<<8))
+}
+
+func TestScaledWindow_OneSide(t *testing.T) {
+	// The remote did not send the option, so neither side scales the windows.
+	f, stat := windowScaleFlow(t, []byte{1, 3, 3, 7}, nil)
+	assertEqual(t, f.isWindowScaleKnown(), true)
+	assertEqual(t, stat.windowKnown, true)
+	assertEqual(t, stat.sentWindowSize, uint32(65535))
+	assertEqual(t, stat.ackWindowSize, uint32(65535))
+}
+
+func TestScaledWindow_SynNotScaled(t *testing.T) {
+	f, _ := windowScaleFlow(t, []byte{1, 3, 3, 7}, []byte{1, 3, 3, 8})
+	syn := &flowPacket{packet: readTestPackets(t, handshake())[1], direction: remoteToLocal}
+	assertEqual(t, f.scaledWindow(syn), uint32(65535))
+}
+
+func TestScaledWindow_NoHandshake(t *testing.T) {
+	segments := []testSegment{
+		{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000},
+		{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001},
+	}
+	f, stats := testFlow(t, &Config{}, segments)
+	assertEqual(t, f.isWindowScaleKnown(), false)
+	assertEqual(t, len(stats), 1)
+	assertEqual(t, stats[0].windowKnown, false)
+	assertEqual(t, stats[0].sentWindowSize, uint32(65535))
+	assertEqual(t, stats[0].ackWindowSize, uint32(65535))
+}
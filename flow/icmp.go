@@ -0,0 +1,79 @@
+package flow
+
+import (
+	"fmt"
+	"jakub-m/bdp/packet"
+	"jakub-m/bdp/pcap"
+)
+
+// pathTracker follows the ICMP errors about the packets of the flow, sent by the routers on the path or by the
+// hosts. mtu is the path MTU from the most recent "fragmentation needed" or "packet too big", zero if there was
+// none. errors counts the other errors, e.g. unreachable or time exceeded.
+type pathTracker struct {
+	mtu    uint32
+	errors int
+}
+
+func (t *pathTracker) String() string {
+	return fmt.Sprintf("mtu %s, errors %d", formatMTU(t.mtu), t.errors)
+}
+
+func formatMTU(mtu uint32) string {
+	if mtu == 0 {
+		return "-"
+	}
+	return fmt.Sprint(mtu)
+}
+
+// consumeICMP picks up an ICMP error that quotes a packet of the flow. A change of the path MTU is reported as
+// "pmtu" event, other errors as "path-error" events. The error must be in the VLAN of the selector, since the same
+// tuple may be used in other VLANs.
+func (f *flow) consumeICMP(packet *packet.Packet, selector *Selector) error {
+	icmp := packet.ICMP
+	if !selector.matchesVLAN(packet) {
+		return fmt.Errorf("Dropping %s > %s (%s, not in the VLAN)", packet.IP.SourceIP(), packet.IP.DestIP(), icmp.Description())
+	}
+	if f.local == nil || f.lifecycle.reused || !icmp.IsPathError() {
+		return fmt.Errorf("Dropping %s > %s (%s, not about the flow)", packet.IP.SourceIP(), packet.IP.DestIP(), icmp.Description())
+	}
+	quoted, err := icmp.Quoted()
+	if err != nil {
+		return err
+	}
+	direction, ok := f.endpoints.quotedDirection(quoted)
+	if !ok {
+		return fmt.Errorf("Dropping %s > %s (%s, about other connection)", packet.IP.SourceIP(), packet.IP.DestIP(), icmp.Description())
+	}
+
+	relativeTimestamp := f.getRelativeTimestamp(packet)
+	sender := "local"
+	if direction == remoteToLocal {
+		sender = "remote"
+	}
+	about := fmt.Sprintf("from %s, about %s seq %d (%d bytes)", packet.IP.SourceIP(), sender,
+		f.quotedSeqNum(direction, quoted.SeqNum), quoted.IP.TotalLength())
+	if !icmp.IsPacketTooBig() {
+		f.path.errors++
+		f.emitEvent(relativeTimestamp, "path-error", fmt.Sprintf("%s %s", icmp.Description(), about))
+		return nil
+	}
+	if icmp.MTU() != f.path.mtu {
+		f.emitEvent(relativeTimestamp, "pmtu", fmt.Sprintf("%s -> %d %s", formatMTU(f.path.mtu), icmp.MTU(), about))
+		f.path.mtu = icmp.MTU()
+	}
+	return nil
+}
+
+// quotedSeqNum is the sequence number of a quoted packet relative to the initial sequence number of its sender.
+// The unwrapper is copied, so the old sequence numbers of the quoted packets do not move it.
+func (f *flow) quotedSeqNum(direction flowPacketDirection, s pcap.SeqNum) uint64 {
+	details := f.local
+	if direction == remoteToLocal {
+		details = f.remote
+	}
+	if details == nil {
+		return 0
+	}
+	seqs := details.seqs
+	return seqs.unwrap(s)
+}
@@ -0,0 +1,88 @@
+package flow
+
+import (
+	"encoding/binary"
+	"jakub-m/bdp/pcap"
+	"jakub-m/bdp/pcap/pcaptest"
+	"testing"
+)
+
+var testRouter = []byte{10, 0, 0, 254}
+
+// icmpFrame is an ICMP error from a router about the local segment, with 1500 bytes of the IP length.
+func icmpFrame(icmpType, code uint8, rest uint32, s testSegment) []byte {
+	tcp := pcaptest.TCP(40000, 443, s.seq, s.ack, s.flags, nil, 0)
+	quoted := pcaptest.IPv4(1500, 1, 0x4000, 6, []byte{10, 0, 0, 1}, []byte{10, 0, 0, 2}, tcp[:8])
+	return pcaptest.IPv4(uint16(20+8+len(quoted)), 2, 0, 1, testRouter, []byte{10, 0, 0, 1}, pcaptest.ICMP(icmpType, code, rest, quoted))
+}
+
+func TestConsumeICMP_PathErrors(t *testing.T) {
+	lost := testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1460}
+	records := []pcaptest.Record{}
+	for _, s := range append(handshake(), testSegment{usec: 25000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000}) {
+		records = append(records, pcaptest.RecordAtUsec(s.usec, buildTestFrame(s)))
+	}
+	records = append(records,
+		pcaptest.RecordAtUsec(30100, pcaptest.Ethernet(icmpFrame(pcap.ICMPTypeDestUnreachable, pcap.ICMPCodeFragNeeded, 1400, lost))),
+		// The same MTU again is not a change.
+		pcaptest.RecordAtUsec(30200, pcaptest.Ethernet(icmpFrame(pcap.ICMPTypeDestUnreachable, pcap.ICMPCodeFragNeeded, 1400, lost))),
+		pcaptest.RecordAtUsec(40000, pcaptest.Ethernet(icmpFrame(pcap.ICMPTypeTimeExceeded, 0, 0, lost))),
+	)
+	packets := decodeTestCapture(t, pcaptest.Write(binary.LittleEndian, pcaptest.MagicMicro, records...))
+
+	localIP, _ := pcap.IPFromString(testLocalIP)
+	remoteIP, _ := pcap.IPFromString(testRemote)
+	selector := &Selector{LocalIP: localIP, RemoteIP: remoteIP}
+	events := []*event{}
+	f := &flow{
+		config: &Config{},
+		cbEvent: func(e *event) {
+			events = append(events, e)
+		},
+	}
+	for _, p := range packets {
+		if p.ICMP != nil {
+			if err := f.consumeICMP(p, selector); err != nil {
+				t.Fatal(err)
+			}
+		} else if _, err := f.consumePacket(p, selector); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertEqual(t, f.path.mtu, uint32(1400))
+	assertEqual(t, f.path.errors, 1)
+	assertEqual(t, f.path.String(), "mtu 1400, errors 1")
+
+	pathEvents := []*event{}
+	for _, e := range events {
+		if e.name != "state" {
+			pathEvents = append(pathEvents, e)
+		}
+	}
+	assertEqual(t, len(pathEvents), 2)
+	assertEqual(t, pathEvents[0].name, "pmtu")
+	assertEqual(t, pathEvents[0].relativeTimestampNSec, uint64(30100*nsecInUsec))
+	assertEqual(t, pathEvents[0].details, "- -> 1400 from 10.0.0.254, about local seq 1001 (1500 bytes)")
+	assertEqual(t, pathEvents[1].name, "path-error")
+}
+
+func TestConsumeICMP_OtherVLAN(t *testing.T) {
+	f, _ := testFlow(t, &Config{}, handshake())
+	vlan := uint16(10)
+	localIP, _ := pcap.IPFromString(testLocalIP)
+	remoteIP, _ := pcap.IPFromString(testRemote)
+	selector := &Selector{LocalIP: localIP, RemoteIP: remoteIP, VLAN: &vlan}
+	s := testSegment{seq: 1001, ack: 5001, flags: testFlagAck}
+	packets := decodeTestCapture(t, pcaptest.Write(binary.LittleEndian, pcaptest.MagicMicro,
+		pcaptest.RecordAtUsec(30000, pcaptest.EthernetVLAN(20, icmpFrame(pcap.ICMPTypeDestUnreachable, pcap.ICMPCodeFragNeeded, 1400, s))),
+		pcaptest.RecordAtUsec(30100, pcaptest.EthernetVLAN(10, icmpFrame(pcap.ICMPTypeDestUnreachable, pcap.ICMPCodeFragNeeded, 1300, s))),
+	))
+	if err := f.consumeICMP(packets[0], selector); err == nil {
+		t.Error("Expected ICMP from other VLAN to be dropped")
+	}
+	assertEqual(t, f.path.mtu, uint32(0))
+	if err := f.consumeICMP(packets[1], selector); err != nil {
+		t.Error(err)
+	}
+	assertEqual(t, f.path.mtu, uint32(1300))
+}
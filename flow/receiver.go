@@ -0,0 +1,164 @@
+package flow
+
+import (
+	"fmt"
+	"log"
+)
+
+// Direction tells which side of the connection sends the data, and so where the estimates are taken.
+type Direction int
+
+const (
+	// Upload is data sent from local to remote. The estimates are sender-side: delivery rate and RTT from the acks.
+	Upload Direction = iota
+	// Download is data sent from remote to local. The estimates are receiver-side: goodput from the arrival rate of
+	// the data, RTT from the handshake and from the timestamp echo.
+	Download
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Upload:
+		return "upload"
+	case Download:
+		return "download"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// DirectionFromString parses direction name.
+func DirectionFromString(s string) (Direction, error) {
+	for _, d := range []Direction{Upload, Download} {
+		if d.String() == s {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown direction: %s", s)
+}
+
+// estimate labels the rows, so it is clear at which side of the connection they were estimated.
+func (d Direction) estimate() string {
+	if d == Download {
+		return "receiver"
+	}
+	return "sender"
+}
+
+// receiver is the state of the receiver-side estimation. The data arrives in rounds of one RTT, and the goodput
+// is the amount of new data received in the round over the duration of the round.
+// rcvNxt is the end of the highest data received, data below it is not new (e.g. retransmitted).
+// received is the sum of new bytes received.
+// lastAck is the most recent local-to-remote packet, it tells the receive window and what was acknowledged.
+// synTime is the time of the local SYN, valid if synSent is set (the capture may start at timestamp zero).
+// handshakeRTT is the time between the local SYN and the remote SYN-ACK, zero if the handshake was not seen.
+// roundRTT is the lowest timestamp echo RTT seen in the round, zero if there was none.
+type receiver struct {
+	rcvNxt        uint64
+	received      uint64
+	roundStart    uint64
+	roundReceived uint64
+	lastAck       *flowPacket
+	synTime       uint64
+	synSent       bool
+	handshakeRTT  uint64
+	roundRTT      uint64
+}
+
+// onSynAck takes the handshake RTT from the SYN-ACK of the remote.
+func (r *receiver) onSynAck(p *flowPacket) {
+	if !r.synSent {
+		return
+	}
+	r.handshakeRTT = p.packet.Record.Timestamp() - r.synTime
+	log.Printf("Handshake RTT: %d usec", r.handshakeRTT/nsecInUsec)
+}
+
+// onReceiverAck records the acks sent by local, the receiver.
+func (f *flow) onReceiverAck(p *flowPacket) {
+	if p.packet.TCP.IsAck() {
+		f.receiver.lastAck = p
+	}
+}
+
+// onData accounts the data sent by remote, and produces a sample at the end of each round.
+func (f *flow) onData(p *flowPacket) {
+	r := &f.receiver
+	if p.packet.PayloadSize() == 0 || p.expectedAckNum <= r.rcvNxt {
+		return
+	}
+	now := p.packet.Record.Timestamp()
+	start := p.relativeSeqNum
+	if start < r.rcvNxt {
+		start = r.rcvNxt
+	}
+	r.received += p.expectedAckNum - start
+	r.rcvNxt = p.expectedAckNum
+	f.delivered = r.received
+	f.deliveredTime = now
+
+	// The remote echoes the most recent TSval of the acks, so it is RTT plus the time the remote had no data to send.
+	// The lowest echo in the round is the closest to RTT.
+	if tsRTT, ok := f.timestamps.rttFor(p.packet); ok && (r.roundRTT == 0 || tsRTT < r.roundRTT) {
+		r.roundRTT = tsRTT
+	}
+
+	if r.roundStart == 0 {
+		// The data of the first packet arrived at the start of the round, it does not count.
+		r.roundStart = now
+		r.roundReceived = r.received
+		return
+	}
+	rtt, rttMethod := r.rtt()
+	if rtt == 0 {
+		log.Printf("Discarding receiver sample for seq=%d, RTT not known yet", p.relativeSeqNum)
+		return
+	}
+	elapsed := now - r.roundStart
+	if elapsed < rtt {
+		return
+	}
+	goodput := 8 * nsecInSec * float64(r.received-r.roundReceived) / float64(elapsed)
+	f.updateRTT(rtt)
+
+	stat := &flowStat{
+		relativeTimestampNSec: p.relativeTimestamp,
+		rttNSec:               rtt,
+		deliveryRateBPS:       uint32(goodput),
+		sentWindowSize:        f.scaledWindow(p),
+		windowKnown:           f.isWindowScaleKnown(),
+		rttMethod:             rttMethod,
+		estimate:              Download.estimate(),
+		pathMTU:               f.path.mtu,
+		pathErrors:            f.path.errors,
+	}
+	if r.lastAck != nil {
+		stat.ackWindowSize = f.scaledWindow(r.lastAck)
+		if r.rcvNxt > r.lastAck.relativeAckNum {
+			stat.windowUsed = windowUsed(r.rcvNxt-r.lastAck.relativeAckNum, stat.ackWindowSize)
+		}
+	}
+	log.Printf("Round ended at seq=%d, goodput=%.0fkb/s, %s", p.relativeSeqNum, goodput/1000, stat)
+	if f.cbAckInFlight != nil {
+		f.cbAckInFlight(stat)
+	}
+
+	r.roundStart = now
+	r.roundReceived = r.received
+	r.roundRTT = 0
+}
+
+// rtt returns RTT of the round, from the timestamp echo if there was one, otherwise from the handshake.
+func (r *receiver) rtt() (uint64, RTTMethod) {
+	if r.roundRTT != 0 {
+		return r.roundRTT, RTTFromTimestamps
+	}
+	return r.handshakeRTT, RTTFromHandshake
+}
+
+// windowUsed tells what fraction of the advertised window is used by the data in flight.
+func windowUsed(inflight uint64, window uint32) float64 {
+	if window == 0 {
+		return 0
+	}
+	return float64(inflight) / float64(window)
+}
@@ -0,0 +1,55 @@
+package flow
+
+import "testing"
+
+func TestOnData_HandshakeRTT(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1001, payload: 1000},
+		testSegment{usec: 40000, fromLocal: false, flags: testFlagAck, seq: 6001, ack: 1001, payload: 1000},
+		testSegment{usec: 40010, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 7001},
+		// The round is one handshake RTT (20 ms) after its first data.
+		testSegment{usec: 55000, fromLocal: false, flags: testFlagAck, seq: 7001, ack: 1001, payload: 1000},
+	)
+	f, stats := testFlow(t, &Config{Direction: Download}, segments)
+	assertEqual(t, f.receiver.handshakeRTT, uint64(20000*nsecInUsec))
+	assertEqual(t, f.delivered, uint64(3000))
+	assertEqual(t, len(stats), 1)
+	s := stats[0]
+	assertEqual(t, s.rttNSec, uint64(20000*nsecInUsec))
+	assertEqual(t, s.rttMethod, RTTFromHandshake)
+	assertEqual(t, s.estimate, "receiver")
+	assertEqual(t, s.deliveryRateBPS, uint32(8*2000*nsecInSec/(25000*nsecInUsec)))
+	assertEqual(t, s.ackWindowSize, uint32(65535))
+	assertEqual(t, s.windowKnown, true)
+	// The last data segment is not acked yet.
+	assertEqual(t, s.windowUsed, float64(1000)/65535)
+}
+
+func TestOnData_TimestampRTT(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1001, payload: 1000},
+		testSegment{usec: 30010, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 6001, options: tsOption(100, 0)},
+		// The echo of the ack above is 15 ms later, before the handshake RTT.
+		testSegment{usec: 45010, fromLocal: false, flags: testFlagAck, seq: 6001, ack: 1001, payload: 1000, options: tsOption(900, 100)},
+	)
+	f, stats := testFlow(t, &Config{Direction: Download}, segments)
+	assertEqual(t, f.delivered, uint64(2000))
+	assertEqual(t, len(stats), 1)
+	s := stats[0]
+	assertEqual(t, s.rttNSec, uint64(15000*nsecInUsec))
+	assertEqual(t, s.rttMethod, RTTFromTimestamps)
+	assertEqual(t, s.deliveryRateBPS, uint32(8*1000*nsecInSec/(15010*nsecInUsec)))
+	assertEqual(t, s.windowUsed, float64(1000)/65535)
+}
+
+func TestOnData_NoHandshake(t *testing.T) {
+	segments := []testSegment{
+		{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001},
+		{usec: 30100, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1001, payload: 1000},
+		{usec: 90000, fromLocal: false, flags: testFlagAck, seq: 6001, ack: 1001, payload: 1000},
+	}
+	f, stats := testFlow(t, &Config{Direction: Download}, segments)
+	// Without the handshake and timestamps, RTT is not known, so there are no rounds.
+	assertEqual(t, f.delivered, uint64(2000))
+	assertEqual(t, len(stats), 0)
+}
@@ -0,0 +1,219 @@
+package flow
+
+import "fmt"
+
+const (
+	// minRTO and initialRTO are as in RFC 6298.
+	minRTO     = 200 * nsecInMsec
+	initialRTO = 1000 * nsecInMsec
+	// dupAckThreshold is the number of duplicate acks that trigger fast retransmit (RFC 5681).
+	dupAckThreshold = 3
+	// maxRecentRetransmissions bounds the retransmissions remembered for the spurious retransmission detection.
+	maxRecentRetransmissions = 64
+)
+
+// retransmitKind tells what most likely triggered a retransmission. The sender state is not visible in the
+// capture, so the kind is guessed from the dup acks, SACK blocks and timing.
+type retransmitKind int
+
+const (
+	// fastRetransmit follows duplicate acks or SACK blocks above the segment.
+	fastRetransmit retransmitKind = iota
+	// rtoRetransmit follows silence longer than the retransmission timeout.
+	rtoRetransmit
+	// tailLossProbe resends the last segment sent, before the retransmission timeout expires.
+	tailLossProbe
+)
+
+func (k retransmitKind) String() string {
+	switch k {
+	case fastRetransmit:
+		return "fast"
+	case rtoRetransmit:
+		return "rto"
+	case tailLossProbe:
+		return "tlp"
+	}
+	return fmt.Sprintf("retransmitKind(%d)", int(k))
+}
+
+// retransmission is a resent sequence range. seqNum and endSeqNum are byte offsets from the local initial sequence
+// number. tsVal is the TCP timestamp of the retransmission, if it had one.
+type retransmission struct {
+	kind      retransmitKind
+	seqNum    uint64
+	endSeqNum uint64
+	timestamp uint64
+	tsVal     uint32
+	hasTSVal  bool
+	spurious  bool
+}
+
+func (r *retransmission) String() string {
+	return fmt.Sprintf("%s seq %d-%d", r.kind, r.seqNum, r.endSeqNum)
+}
+
+// retransmitTracker counts the retransmissions of a flow, and remembers the recent ones so D-SACK blocks can be
+// matched with them.
+type retransmitTracker struct {
+	counts   [tailLossProbe + 1]int
+	spurious int
+	recent   []*retransmission
+}
+
+func (t *retransmitTracker) add(r *retransmission) {
+	t.counts[r.kind]++
+	if len(t.recent) == maxRecentRetransmissions {
+		t.recent[0] = nil
+		t.recent = t.recent[1:]
+	}
+	t.recent = append(t.recent, r)
+}
+
+func (t *retransmitTracker) total() int {
+	total := 0
+	for _, n := range t.counts {
+		total += n
+	}
+	return total
+}
+
+func (t *retransmitTracker) String() string {
+	return fmt.Sprintf("fast %d, rto %d, tlp %d, spurious %d",
+		t.counts[fastRetransmit], t.counts[rtoRetransmit], t.counts[tailLossProbe], t.spurious)
+}
+
+// rtoEstimator computes the retransmission timeout from RTT samples, as in RFC 6298.
+type rtoEstimator struct {
+	srtt      uint64
+	rttvar    uint64
+	hasSample bool
+}
+
+func (e *rtoEstimator) update(rtt uint64) {
+	if !e.hasSample {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.hasSample = true
+		return
+	}
+	var delta uint64
+	if e.srtt > rtt {
+		delta = e.srtt - rtt
+	} else {
+		delta = rtt - e.srtt
+	}
+	e.rttvar = (3*e.rttvar + delta) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+}
+
+func (e *rtoEstimator) rto() uint64 {
+	if !e.hasSample {
+		return initialRTO
+	}
+	rto := e.srtt + 4*e.rttvar
+	if rto < minRTO {
+		return minRTO
+	}
+	return rto
+}
+
+// updateRTT feeds a valid RTT sample to min RTT and to the retransmission timeout estimator.
+func (f *flow) updateRTT(rtt uint64) {
+	if f.minRTT == 0 || rtt < f.minRTT {
+		f.minRTT = rtt
+	}
+	f.rto.update(rtt)
+}
+
+// onRetransmit records a segment overlapping the data already sent. The inflight packets it covers are marked as
+// retransmitted, so they are excluded from the RTT sampling (Karn's algorithm), and their delivery state is taken
+// anew, as the delivery rate draft says.
+func (f *flow) onRetransmit(p *flowPacket) {
+	now := p.packet.Record.Timestamp()
+	r := &retransmission{
+		kind:      f.classifyRetransmit(p, now),
+		seqNum:    p.relativeSeqNum,
+		endSeqNum: p.expectedAckNum,
+		timestamp: now,
+	}
+	if options := p.packet.TCP.Options(); options.HasTimestamps {
+		r.tsVal = options.TSVal
+		r.hasTSVal = true
+	}
+	f.retransmits.add(r)
+	f.emitEvent(p.relativeTimestamp, "retransmit", r.String())
+
+	for _, sent := range f.inflight {
+		if sent.expectedAckNum <= r.seqNum || sent.relativeSeqNum >= r.endSeqNum {
+			continue
+		}
+		sent.retransmission = r
+		sent.retransmitTime = now
+		f.onPacketSent(sent)
+	}
+	f.lastSentTime = now
+
+	if r.endSeqNum <= f.highestAckNum {
+		// The data was acknowledged before it was resent.
+		f.markSpurious(r, "already acked", p.relativeTimestamp)
+	}
+}
+
+// classifyRetransmit guesses what triggered the retransmission. Fast retransmit follows enough duplicate acks or
+// SACKed data above the segment. Otherwise, resending the tail before the RTO expires is a tail loss probe, and
+// anything else is RTO.
+func (f *flow) classifyRetransmit(p *flowPacket, now uint64) retransmitKind {
+	if f.dupAcks >= dupAckThreshold {
+		return fastRetransmit
+	}
+	for _, sent := range f.inflight {
+		if sent.sacked && sent.relativeSeqNum >= p.expectedAckNum {
+			return fastRetransmit
+		}
+	}
+	if p.expectedAckNum >= f.highestSentEnd && now-f.lastSentTime < f.rto.rto() {
+		return tailLossProbe
+	}
+	return rtoRetransmit
+}
+
+// detectDSACK marks the retransmissions reported by a D-SACK block as spurious (RFC 2883). D-SACK is the first
+// SACK block, and it is below the cumulative ack.
+func (f *flow) detectDSACK(ack *flowPacket) {
+	blocks := ack.packet.TCP.Options().SACKBlocks
+	if len(blocks) == 0 {
+		return
+	}
+	left := f.local.relative(blocks[0].Left)
+	right := f.local.relative(blocks[0].Right)
+	if right > ack.relativeAckNum {
+		return
+	}
+	for _, r := range f.retransmits.recent {
+		if r.spurious || r.endSeqNum <= left || r.seqNum >= right {
+			continue
+		}
+		f.markSpurious(r, "dsack", ack.relativeTimestamp)
+	}
+}
+
+// detectEifel marks the retransmission of the acknowledged packet as spurious if the ack echoes a timestamp older
+// than the retransmission, i.e. the ack was for the original transmission (RFC 3522).
+func (f *flow) detectEifel(ack *flowPacket, p *flowPacket) {
+	r := p.retransmission
+	if r == nil || r.spurious || !r.hasTSVal {
+		return
+	}
+	options := ack.packet.TCP.Options()
+	if !options.HasTimestamps || !tsAfter(r.tsVal, options.TSEcr) {
+		return
+	}
+	f.markSpurious(r, "eifel", ack.relativeTimestamp)
+}
+
+func (f *flow) markSpurious(r *retransmission, reason string, relativeTimestamp uint64) {
+	r.spurious = true
+	f.retransmits.spurious++
+	f.emitEvent(relativeTimestamp, "spurious", fmt.Sprintf("%s (%s)", r, reason))
+}
@@ -0,0 +1,99 @@
+package flow
+
+import (
+	"fmt"
+	"jakub-m/bdp/packet"
+	"jakub-m/bdp/pcap"
+)
+
+// Selector chooses the connection to analyse. Ports equal to 0 match any port. If VLAN is not nil, only
+// the packets tagged with that VLAN ID are considered.
+type Selector struct {
+	LocalIP    pcap.IP
+	RemoteIP   pcap.IP
+	LocalPort  uint16
+	RemotePort uint16
+	VLAN       *uint16
+}
+
+// matches tells if the packet goes between the selected local and remote, in any direction.
+func (s *Selector) matches(p *packet.Packet) bool {
+	if !s.matchesVLAN(p) {
+		return false
+	}
+	return s.isLocalToRemote(p) || s.isRemoteToLocal(p)
+}
+
+// matchesVLAN tells if the packet is tagged with the selected VLAN ID, if any.
+func (s *Selector) matchesVLAN(p *packet.Packet) bool {
+	return s.VLAN == nil || p.HasVLAN(*s.VLAN)
+}
+
+func (s *Selector) isLocalToRemote(p *packet.Packet) bool {
+	return p.IP.SourceIP() == s.LocalIP && p.IP.DestIP() == s.RemoteIP &&
+		matchesPort(s.LocalPort, p.TCP.SourcePort()) && matchesPort(s.RemotePort, p.TCP.DestPort())
+}
+
+func (s *Selector) isRemoteToLocal(p *packet.Packet) bool {
+	return p.IP.SourceIP() == s.RemoteIP && p.IP.DestIP() == s.LocalIP &&
+		matchesPort(s.RemotePort, p.TCP.SourcePort()) && matchesPort(s.LocalPort, p.TCP.DestPort())
+}
+
+func matchesPort(selected, port uint16) bool {
+	return selected == 0 || selected == port
+}
+
+// endpoints identify a single TCP connection by its 4-tuple.
+type endpoints struct {
+	localIP    pcap.IP
+	localPort  uint16
+	remoteIP   pcap.IP
+	remotePort uint16
+}
+
+// newEndpointsFromLocalSource creates endpoints from a local-to-remote packet.
+func newEndpointsFromLocalSource(p *packet.Packet) endpoints {
+	return endpoints{
+		localIP:    p.IP.SourceIP(),
+		localPort:  p.TCP.SourcePort(),
+		remoteIP:   p.IP.DestIP(),
+		remotePort: p.TCP.DestPort(),
+	}
+}
+
+func (e endpoints) isLocalToRemote(p *packet.Packet) bool {
+	return e.localIP == p.IP.SourceIP() && e.localPort == p.TCP.SourcePort() &&
+		e.remoteIP == p.IP.DestIP() && e.remotePort == p.TCP.DestPort()
+}
+
+func (e endpoints) isRemoteToLocal(p *packet.Packet) bool {
+	return e.remoteIP == p.IP.SourceIP() && e.remotePort == p.TCP.SourcePort() &&
+		e.localIP == p.IP.DestIP() && e.localPort == p.TCP.DestPort()
+}
+
+// quotedDirection tells the direction of a packet quoted in an ICMP error, if the packet is of the connection.
+func (e endpoints) quotedDirection(q *pcap.QuotedPacket) (flowPacketDirection, bool) {
+	if q.IP.Protocol() != pcap.IPProtoTCP {
+		return localToRemote, false
+	}
+	src, dst := q.IP.SourceIP(), q.IP.DestIP()
+	if e.localIP == src && e.localPort == q.SourcePort && e.remoteIP == dst && e.remotePort == q.DestPort {
+		return localToRemote, true
+	}
+	if e.remoteIP == src && e.remotePort == q.SourcePort && e.localIP == dst && e.localPort == q.DestPort {
+		return remoteToLocal, true
+	}
+	return localToRemote, false
+}
+
+func (e endpoints) String() string {
+	return fmt.Sprintf("%s > %s", formatEndpoint(e.localIP, e.localPort), formatEndpoint(e.remoteIP, e.remotePort))
+}
+
+// formatEndpoint formats IP and port, with IPv6 addresses in brackets.
+func formatEndpoint(ip pcap.IP, port uint16) string {
+	if ip.Is4() {
+		return fmt.Sprintf("%s:%d", ip, port)
+	}
+	return fmt.Sprintf("[%s]:%d", ip, port)
+}
@@ -0,0 +1,25 @@
+package flow
+
+import "jakub-m/bdp/pcap"
+
+// seqUnwrapper turns 32 bit sequence numbers of one direction into 64 bit byte offsets from the initial sequence
+// number, so transfers over 4 GiB are tracked correctly. The offset closest to the highest one seen so far is
+// picked, so the sequence numbers may lag behind by up to 2 GiB (e.g. retransmissions, old acks).
+type seqUnwrapper struct {
+	initSeqNum pcap.SeqNum
+	highest    uint64
+}
+
+func (u *seqUnwrapper) unwrap(s pcap.SeqNum) uint64 {
+	highestSeqNum := u.initSeqNum.Add(uint32(u.highest))
+	delta := int64(s.Diff(highestSeqNum))
+	if delta < 0 && uint64(-delta) > u.highest {
+		// Before the initial sequence number, e.g. a keep-alive probe.
+		return 0
+	}
+	offset := uint64(int64(u.highest) + delta)
+	if offset > u.highest {
+		u.highest = offset
+	}
+	return offset
+}
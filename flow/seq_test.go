@@ -0,0 +1,44 @@
+package flow
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+const gib = 1 << 30
+
+func TestSeqUnwrapper_InitSeqNumNearWraparound(t *testing.T) {
+	isn := pcap.SeqNum(0xFFFFFFF0)
+	u := seqUnwrapper{initSeqNum: isn}
+	assertEqual(t, u.unwrap(isn), uint64(0))
+	assertEqual(t, u.unwrap(isn.Add(1)), uint64(1))
+	// Past 2^32 of the raw sequence numbers.
+	assertEqual(t, u.unwrap(pcap.SeqNum(0x10)), uint64(0x20))
+	assertEqual(t, u.unwrap(pcap.SeqNum(1000)), uint64(1016))
+	// A late packet from before the raw sequence numbers wrapped.
+	assertEqual(t, u.unwrap(isn.Add(2)), uint64(2))
+	assertEqual(t, u.unwrap(pcap.SeqNum(2000)), uint64(2016))
+}
+
+func TestSeqUnwrapper_BeforeInitSeqNum(t *testing.T) {
+	isn := pcap.SeqNum(10)
+	u := seqUnwrapper{initSeqNum: isn}
+	u.unwrap(isn.Add(1))
+	// Keep-alive probe, one byte before the next expected.
+	assertEqual(t, u.unwrap(pcap.SeqNum(0xFFFFFFFF)), uint64(0))
+}
+
+func TestSeqUnwrapper_LongerThan4GiB(t *testing.T) {
+	isn := pcap.SeqNum(0xFFFFFF00)
+	u := seqUnwrapper{initSeqNum: isn}
+	for offset := uint64(1); offset < 9*gib; offset += gib {
+		assertEqual(t, u.unwrap(isn.Add(uint32(offset))), offset)
+	}
+	highest := uint64(8*gib + 1)
+	// Late ack, 1 GiB behind the highest offset, the raw number is the same as 4 GiB and 8 GiB earlier.
+	assertEqual(t, u.unwrap(isn.Add(uint32(highest-gib))), highest-gib)
+	// SACK block edges slightly ahead of the highest offset.
+	assertEqual(t, u.unwrap(isn.Add(uint32(highest+1000))), highest+1000)
+	assertEqual(t, u.unwrap(isn.Add(uint32(highest+2000))), highest+2000)
+	assertEqual(t, u.highest, highest+2000)
+}
@@ -0,0 +1,178 @@
+package flow
+
+import (
+	"fmt"
+	"jakub-m/bdp/packet"
+)
+
+// connState is the state of the connection as seen from the capture. It is simpler than the state machine of
+// RFC 793, since the capture shows both sides at once.
+type connState int
+
+const (
+	stateNone connState = iota
+	stateSynSent
+	stateSynReceived
+	stateEstablished
+	// stateHalfClosed is after FIN of one side.
+	stateHalfClosed
+	// stateClosing is after FIN of both sides, until the last FIN is acknowledged.
+	stateClosing
+	// stateTimeWait is after both FINs are acknowledged, the connection is closed.
+	stateTimeWait
+	stateReset
+)
+
+func (s connState) String() string {
+	switch s {
+	case stateNone:
+		return "none"
+	case stateSynSent:
+		return "syn-sent"
+	case stateSynReceived:
+		return "syn-received"
+	case stateEstablished:
+		return "established"
+	case stateHalfClosed:
+		return "half-closed"
+	case stateClosing:
+		return "closing"
+	case stateTimeWait:
+		return "time-wait"
+	case stateReset:
+		return "reset"
+	}
+	return fmt.Sprintf("connState(%d)", int(s))
+}
+
+// lifecycle tracks the state of the connection and records when it changed. The times are capture timestamps,
+// zero if the state was not reached. localFinEnd and remoteFinEnd are the sequence numbers following FIN of each
+// side, zero if FIN was not sent. reused is set when a new connection starts on the same tuple after this one was
+// terminated or closing.
+type lifecycle struct {
+	state          connState
+	handshakeTime  uint64
+	dataTime       uint64
+	halfCloseTime  uint64
+	closeTime      uint64
+	resetTime      uint64
+	localFinEnd    uint64
+	remoteFinEnd   uint64
+	localFinAcked  bool
+	remoteFinAcked bool
+	reused         bool
+}
+
+// isTerminated tells if the connection was closed or reset, so the same tuple can be reused by a new connection.
+func (l *lifecycle) isTerminated() bool {
+	return l.state == stateTimeWait || l.state == stateReset
+}
+
+// isNewInstance tells if the packet starts a new connection on the same tuple. That is a bare SYN after the
+// connection was terminated, or after any FIN when the ISN differs from the one of this connection (the old SYN
+// retransmitted would have the same ISN).
+func (f *flow) isNewInstance(p *packet.Packet) bool {
+	if !p.TCP.IsSyn() || p.TCP.IsAck() {
+		return false
+	}
+	l := &f.lifecycle
+	if l.isTerminated() {
+		return true
+	}
+	if l.localFinEnd == 0 && l.remoteFinEnd == 0 {
+		return false
+	}
+	details := f.local
+	if f.isRemoteToLocal(p) {
+		details = f.remote
+	}
+	return details != nil && p.TCP.SeqNum() != details.initSeqNum
+}
+
+// updateLifecycle moves the state machine with a packet of the flow, and emits an event on each state change.
+func (f *flow) updateLifecycle(p *flowPacket) {
+	l := &f.lifecycle
+	tcp := p.packet.TCP
+	now := p.packet.Record.Timestamp()
+	prev := l.state
+
+	switch {
+	case tcp.IsRst():
+		if l.state != stateReset {
+			l.state = stateReset
+			l.resetTime = now
+		}
+	case l.isTerminated():
+		// Late packets, e.g. retransmitted FIN, do not change the state.
+	case tcp.IsSyn() && !tcp.IsAck():
+		if l.state == stateNone {
+			l.state = stateSynSent
+		}
+	case tcp.IsSyn():
+		if l.state < stateSynReceived {
+			l.state = stateSynReceived
+		}
+	default:
+		if l.state < stateEstablished {
+			// The handshake is done, or it was not captured at all.
+			l.state = stateEstablished
+			l.handshakeTime = now
+		}
+		f.updateClosing(p, now)
+	}
+
+	if l.state != prev {
+		f.emitEvent(p.relativeTimestamp, "state", fmt.Sprintf("%s -> %s", prev, l.state))
+	}
+}
+
+// updateClosing follows the data transfer and FINs of an established connection.
+func (f *flow) updateClosing(p *flowPacket, now uint64) {
+	l := &f.lifecycle
+	tcp := p.packet.TCP
+	if l.dataTime == 0 && p.packet.PayloadSize() > 0 {
+		l.dataTime = now
+	}
+	// FIN takes one sequence number, after the payload.
+	if p.direction == localToRemote {
+		if tcp.IsFin() && l.localFinEnd == 0 {
+			l.localFinEnd = p.expectedAckNum + 1
+		}
+		if tcp.IsAck() && l.remoteFinEnd != 0 && p.relativeAckNum >= l.remoteFinEnd {
+			l.remoteFinAcked = true
+		}
+	} else {
+		if tcp.IsFin() && l.remoteFinEnd == 0 {
+			l.remoteFinEnd = p.expectedAckNum + 1
+		}
+		if tcp.IsAck() && l.localFinEnd != 0 && p.relativeAckNum >= l.localFinEnd {
+			l.localFinAcked = true
+		}
+	}
+
+	switch {
+	case l.localFinAcked && l.remoteFinAcked:
+		l.state = stateTimeWait
+		l.closeTime = now
+	case l.localFinEnd != 0 && l.remoteFinEnd != 0:
+		l.state = stateClosing
+	case l.localFinEnd != 0 || l.remoteFinEnd != 0:
+		if l.state != stateHalfClosed {
+			l.state = stateHalfClosed
+			l.halfCloseTime = now
+		}
+	}
+}
+
+// describe lists the state and the times of the lifecycle, relative to initTimestamp.
+func (l *lifecycle) describe(initTimestamp uint64) string {
+	formatTime := func(t uint64) string {
+		if t == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%d usec", (t-initTimestamp)/nsecInUsec)
+	}
+	return fmt.Sprintf("%s, handshake %s, data %s, half-close %s, close %s, reset %s", l.state,
+		formatTime(l.handshakeTime), formatTime(l.dataTime), formatTime(l.halfCloseTime), formatTime(l.closeTime),
+		formatTime(l.resetTime))
+}
@@ -0,0 +1,94 @@
+package flow
+
+import (
+	"fmt"
+	"jakub-m/bdp/packet"
+)
+
+// RTTMethod tells how RTT samples are taken.
+type RTTMethod int
+
+const (
+	// RTTFromSeq matches the ack number with the sequence number of the segment sent.
+	RTTFromSeq RTTMethod = iota
+	// RTTFromTimestamps matches TSecr of the ack with TSval of the segment sent (RFC 7323). If the segments
+	// have no timestamps, it falls back to RTTFromSeq.
+	RTTFromTimestamps
+	// RTTFromHandshake is the time between SYN and SYN-ACK. It is used only for the receiver-side estimates, when
+	// there are no timestamps.
+	RTTFromHandshake
+)
+
+func (m RTTMethod) String() string {
+	switch m {
+	case RTTFromSeq:
+		return "seq"
+	case RTTFromTimestamps:
+		return "ts"
+	case RTTFromHandshake:
+		return "syn"
+	}
+	return fmt.Sprintf("RTTMethod(%d)", int(m))
+}
+
+// RTTMethodFromString parses RTT method name, as printed in the CSV.
+func RTTMethodFromString(s string) (RTTMethod, error) {
+	for _, m := range []RTTMethod{RTTFromSeq, RTTFromTimestamps} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown RTT method: %s", s)
+}
+
+// timestampsOptionSize is the size of the timestamps option in each segment, with the padding (RFC 7323).
+const timestampsOptionSize = 12
+
+// tsSample is the time at which a TSval was sent for the first time.
+type tsSample struct {
+	tsVal     uint32
+	timestamp uint64
+}
+
+// tsTracker remembers when the TSvals were sent, so the echoed TSecr can be turned into RTT sample. Samples
+// older than the echoed one are dropped, so memory is proportional to the inflight window.
+type tsTracker struct {
+	sent []tsSample
+}
+
+// onSend records the TSval of a local-to-remote segment. Only the first segment with given TSval is recorded,
+// since TSval does not change for segments sent within the same clock tick.
+func (t *tsTracker) onSend(p *packet.Packet) {
+	options := p.TCP.Options()
+	if !options.HasTimestamps {
+		return
+	}
+	if n := len(t.sent); n > 0 && !tsAfter(options.TSVal, t.sent[n-1].tsVal) {
+		return
+	}
+	t.sent = append(t.sent, tsSample{tsVal: options.TSVal, timestamp: p.Record.Timestamp()})
+}
+
+// rttFor returns RTT for the TSecr echoed by the ack. It should be called only for acks that acknowledge new
+// data, as RFC 7323 says.
+func (t *tsTracker) rttFor(ack *packet.Packet) (rtt uint64, ok bool) {
+	options := ack.TCP.Options()
+	if !options.HasTimestamps {
+		return 0, false
+	}
+	i := 0
+	for ; i < len(t.sent) && tsAfter(options.TSEcr, t.sent[i].tsVal); i++ {
+	}
+	if i < len(t.sent) && t.sent[i].tsVal == options.TSEcr {
+		rtt = ack.Record.Timestamp() - t.sent[i].timestamp
+		ok = true
+	}
+	// Drop the samples that are older than the echoed one, they won't be echoed anymore.
+	t.sent = t.sent[i:]
+	return rtt, ok
+}
+
+// tsAfter compares timestamps in serial number arithmetic, since TSval wraps.
+func tsAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
@@ -0,0 +1,65 @@
+package flow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTSTracker_MatchAndPrune(t *testing.T) {
+	packets := readTestPackets(t, []testSegment{
+		{usec: 1000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 100, options: tsOption(1, 0)},
+		{usec: 2000, fromLocal: true, flags: testFlagAck, seq: 1101, ack: 5001, payload: 100, options: tsOption(2, 0)},
+		// Same TSval within the clock tick, only the first one counts.
+		{usec: 2500, fromLocal: true, flags: testFlagAck, seq: 1201, ack: 5001, payload: 100, options: tsOption(2, 0)},
+		{usec: 3000, fromLocal: true, flags: testFlagAck, seq: 1301, ack: 5001, payload: 100, options: tsOption(3, 0)},
+		{usec: 9000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1201, options: tsOption(50, 2)},
+		{usec: 9500, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 1401, options: tsOption(51, 9)},
+	})
+	tracker := &tsTracker{}
+	for _, p := range packets[:4] {
+		tracker.onSend(p)
+	}
+	assertEqual(t, len(tracker.sent), 3)
+
+	rtt, ok := tracker.rttFor(packets[4])
+	assertEqual(t, ok, true)
+	assertEqual(t, rtt, uint64(7000*nsecInUsec))
+	// TSval 1 will not be echoed anymore.
+	assertEqual(t, tracker.sent[0].tsVal, uint32(2))
+
+	_, ok = tracker.rttFor(packets[5])
+	assertEqual(t, ok, false)
+	assertEqual(t, len(tracker.sent), 0)
+}
+
+func TestOnAck_TimestampRTT(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000, options: tsOption(10, 0)},
+		testSegment{usec: 30100, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1000, options: tsOption(11, 0)},
+		// The delayed ack echoes the TSval of the first segment, not the one matching the ack number.
+		testSegment{usec: 60000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 3001, options: tsOption(90, 10)},
+	)
+	_, stats := testFlow(t, &Config{RTTMethod: RTTFromTimestamps}, segments)
+	assertEqual(t, len(stats), 1)
+	assertEqual(t, stats[0].rttNSec, uint64(30000*nsecInUsec))
+	assertEqual(t, stats[0].rttMethod, RTTFromTimestamps)
+	assertEqual(t, strings.Split(stats[0].CSVString(), "\t")[5], "ts")
+}
+
+func TestOnAck_TimestampFallbackToSeq(t *testing.T) {
+	segments := append(handshake(),
+		testSegment{usec: 30000, fromLocal: true, flags: testFlagAck, seq: 1001, ack: 5001, payload: 1000, options: tsOption(10, 0)},
+		// TSecr does not match any TSval sent.
+		testSegment{usec: 50000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 2001, options: tsOption(90, 77)},
+		// No timestamps at all.
+		testSegment{usec: 60000, fromLocal: true, flags: testFlagAck, seq: 2001, ack: 5001, payload: 1000},
+		testSegment{usec: 85000, fromLocal: false, flags: testFlagAck, seq: 5001, ack: 3001},
+	)
+	_, stats := testFlow(t, &Config{RTTMethod: RTTFromTimestamps}, segments)
+	assertEqual(t, len(stats), 2)
+	assertEqual(t, stats[0].rttNSec, uint64(20000*nsecInUsec))
+	assertEqual(t, stats[0].rttMethod, RTTFromSeq)
+	assertEqual(t, strings.Split(stats[0].CSVString(), "\t")[5], "seq")
+	assertEqual(t, stats[1].rttNSec, uint64(25000*nsecInUsec))
+	assertEqual(t, stats[1].rttMethod, RTTFromSeq)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"jakub-m/bdp/pcap"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const stdinFname = "-"
+
+// Magic numbers of the supported compression formats.
+var (
+	gzipMagic = []byte{0x1F, 0x8B}
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	xzMagic   = []byte{0xFD, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// followPollInterval is how often a followed capture file is checked for new records.
+const followPollInterval = 200 * time.Millisecond
+
+// input is the capture stream, with all the resources that need to be released after reading.
+type input struct {
+	io.Reader
+	closers  []func() error
+	follower *pcap.FollowReader
+}
+
+func (in *input) Close() error {
+	var firstErr error
+	// Close in reverse order, the decompressor first, the file last.
+	for i := len(in.closers) - 1; i >= 0; i-- {
+		if err := in.closers[i](); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openInput opens the capture file, or stdin if the file name is "-". Compressed captures are detected by
+// the magic number and decompressed on the fly, so nothing is buffered whole. gzip is handled natively, zstd
+// and xz need the respective tools installed. If follow is set, the file is read as it grows, until
+// stopFollowing is called.
+func openInput(fname string, follow bool) (*input, error) {
+	in := &input{}
+	var r io.Reader
+	if fname == stdinFname {
+		if follow {
+			return nil, fmt.Errorf("Cannot follow stdin")
+		}
+		r = os.Stdin
+	} else {
+		file, err := os.Open(fname)
+		if err != nil {
+			return nil, err
+		}
+		in.closers = append(in.closers, file.Close)
+		r = file
+	}
+	if follow {
+		// Follow below decompression and format detection, so they block until the data is written.
+		in.follower = pcap.NewFollowReader(r, followPollInterval)
+		r = in.follower
+	}
+
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(xzMagic))
+	if err != nil && err != io.EOF {
+		in.Close()
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		in.closers = append(in.closers, gz.Close)
+		in.Reader = gz
+	case bytes.HasPrefix(magic, zstdMagic):
+		err = in.decompressWith(buffered, "zstd", "-dc")
+	case bytes.HasPrefix(magic, xzMagic):
+		err = in.decompressWith(buffered, "xz", "-dc")
+	default:
+		in.Reader = buffered
+	}
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+// stopFollowing makes the followed input end at the data written so far.
+func (in *input) stopFollowing() {
+	if in.follower != nil {
+		in.follower.Stop()
+	}
+}
+
+// decompressWith pipes the compressed stream through an external decompressing tool.
+func (in *input) decompressWith(r io.Reader, name string, args ...string) error {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return fmt.Errorf("%s is needed to read the compressed capture: %s", name, err)
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	output := &commandOutput{ReadCloser: stdout, cmd: cmd, name: name}
+	in.closers = append(in.closers, output.Close)
+	in.Reader = output
+	return nil
+}
+
+// commandOutput reads stdout of a command. At the end of the output it waits for the command, so its failure
+// (e.g. a corrupted or cut compressed file) is returned by Read instead of io.EOF.
+type commandOutput struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	name    string
+	waited  bool
+	waitErr error
+}
+
+func (o *commandOutput) Read(p []byte) (int, error) {
+	n, err := o.ReadCloser.Read(p)
+	if err == io.EOF {
+		if waitErr := o.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (o *commandOutput) Close() error {
+	// The tool may still be writing if the reading stopped early. Closing the pipe first makes its writes fail, so
+	// it exits and the wait does not block for long.
+	o.ReadCloser.Close()
+	return o.wait()
+}
+
+func (o *commandOutput) wait() error {
+	if !o.waited {
+		o.waited = true
+		if err := o.cmd.Wait(); err != nil {
+			o.waitErr = fmt.Errorf("%s failed: %s", o.name, err)
+		}
+	}
+	return o.waitErr
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"jakub-m/bdp/pcap/pcaptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func testCapture() []byte {
+	return pcaptest.Write(binary.LittleEndian, pcaptest.MagicMicro,
+		pcaptest.RecordAtUsec(10, []byte{1, 2, 3, 4}),
+		pcaptest.RecordAtUsec(20, []byte{5, 6, 7, 8}),
+	).Bytes()
+}
+
+func writeTempFile(t *testing.T, name string, content []byte) string {
+	fname := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fname, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fname
+}
+
+// readInput reads the whole input, and returns the content and the error of reading or closing it.
+func readInput(t *testing.T, fname string) ([]byte, error) {
+	in, err := openInput(fname, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := io.ReadAll(in)
+	if closeErr := in.Close(); err == nil {
+		err = closeErr
+	}
+	return content, err
+}
+
+func TestOpenInput_Plain(t *testing.T) {
+	capture := testCapture()
+	content, err := readInput(t, writeTempFile(t, "dump.pcap", capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, capture) {
+		t.Errorf("Expected %v, got %v", capture, content)
+	}
+}
+
+func TestOpenInput_Gzip(t *testing.T) {
+	capture := testCapture()
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write(capture)
+	gz.Close()
+	content, err := readInput(t, writeTempFile(t, "dump.pcap.gz", compressed.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, capture) {
+		t.Errorf("Expected %v, got %v", capture, content)
+	}
+}
+
+// compressWith compresses the content with an external tool, the test is skipped if the tool is not installed.
+func compressWith(t *testing.T, content []byte, name string) []byte {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skipf("%s not installed", name)
+	}
+	cmd := exec.Command(path, "-c")
+	cmd.Stdin = bytes.NewReader(content)
+	compressed, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+func TestOpenInput_Xz(t *testing.T) {
+	capture := testCapture()
+	content, err := readInput(t, writeTempFile(t, "dump.pcap.xz", compressWith(t, capture, "xz")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, capture) {
+		t.Errorf("Expected %v, got %v", capture, content)
+	}
+}
+
+func TestOpenInput_Zstd(t *testing.T) {
+	capture := testCapture()
+	content, err := readInput(t, writeTempFile(t, "dump.pcap.zst", compressWith(t, capture, "zstd")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, capture) {
+		t.Errorf("Expected %v, got %v", capture, content)
+	}
+}
+
+func TestOpenInput_XzCut(t *testing.T) {
+	compressed := compressWith(t, bytes.Repeat(testCapture(), 100), "xz")
+	_, err := readInput(t, writeTempFile(t, "dump.pcap.xz", compressed[:len(compressed)/2]))
+	if err == nil {
+		t.Error("Expected the failure of xz to be reported")
+	}
+}
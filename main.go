@@ -9,34 +9,115 @@ import (
 	"jakub-m/bdp/stats"
 	"log"
 	"os"
+	"os/signal"
 )
 
 var args struct {
-	pcapFname string
-	localIP   *pcap.IPv4
-	remoteIP  *pcap.IPv4
-	statsMode bool
+	pcapFname   string
+	localIP     *pcap.IP
+	remoteIP    *pcap.IP
+	localPort   uint16
+	remotePort  uint16
+	vlan        *uint16
+	statsMode   bool
+	allMode     bool
+	follow      bool
+	rttMethod   flow.RTTMethod
+	direction   flow.Direction
+	eventsFname string
+	checksums   packet.ChecksumMode
+	splitGSO    bool
 }
 
-func init() {
+// parseArgs parses the command line. It is not done in init, so the tests of the package can run.
+func parseArgs() {
 	var localIPString string
 	var remoteIPString string
-	flag.StringVar(&args.pcapFname, "i", "", "pcap file")
-	flag.StringVar(&localIPString, "l", "", "local IP (e.g. 192.168.1.2)")
-	flag.StringVar(&remoteIPString, "r", "", "remote IP (e.g. 123.123.123.123)")
+	var localPort int
+	var remotePort int
+	var vlan int
+	var rttMethod string
+	var direction string
+	var checksums string
+	flag.StringVar(&args.pcapFname, "i", "", "pcap file, \"-\" for stdin (can be compressed with gzip, zstd or xz)")
+	flag.StringVar(&localIPString, "l", "", "local IP (e.g. 192.168.1.2 or 2001:db8::2)")
+	flag.StringVar(&remoteIPString, "r", "", "remote IP (e.g. 123.123.123.123 or 2001:db8::123)")
+	flag.IntVar(&localPort, "lport", 0, "local port, 0 for any (e.g. 54321)")
+	flag.IntVar(&remotePort, "rport", 0, "remote port, 0 for any (e.g. 443)")
+	flag.IntVar(&vlan, "vlan", -1, "VLAN ID, consider only packets with that VLAN tag (e.g. 100)")
 	flag.BoolVar(&args.statsMode, "s", false, "Print rudimentary flow statistics")
+	flag.BoolVar(&args.allMode, "a", false, "Analyse all TCP connections, connection id is the last column")
+	flag.StringVar(&rttMethod, "rtt", "seq", "RTT estimator: \"seq\" (ack matching sequence number) or \"ts\" (TCP timestamp echo)")
+	flag.StringVar(&direction, "dir", "upload", "data direction: \"upload\" (local sends, sender-side estimates) or \"download\" (remote sends, receiver-side estimates)")
+	flag.BoolVar(&args.follow, "follow", false, "Follow the pcap file as it is written, stop with Ctrl-C")
+	flag.StringVar(&args.eventsFname, "events", "", "write flow events (e.g. retransmissions) to this file")
+	flag.BoolVar(&args.splitGSO, "split-gso", false, "split TSO/GSO super-segments captured on the sending host into MSS-sized segments (less the timestamps option, if negotiated) for the delivery rate")
+	flag.StringVar(&checksums, "checksum", "off", "IPv4 and TCP checksum verification: \"off\", \"strict\" or \"offload\" (tolerates offloaded checksums of captures on the sending host)")
 	flag.Parse()
 
 	args.localIP = ipFromStringOrExit(localIPString)
 	args.remoteIP = ipFromStringOrExit(remoteIPString)
+	args.localPort = portOrExit(localPort)
+	args.remotePort = portOrExit(remotePort)
+	args.vlan = vlanOrExit(vlan)
+	args.rttMethod = rttMethodOrExit(rttMethod)
+	args.direction = directionOrExit(direction)
+	args.checksums = checksumModeOrExit(checksums)
 }
 
-func ipFromStringOrExit(ipString string) *pcap.IPv4 {
+func rttMethodOrExit(s string) flow.RTTMethod {
+	m, err := flow.RTTMethodFromString(s)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return m
+}
+
+func directionOrExit(s string) flow.Direction {
+	d, err := flow.DirectionFromString(s)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return d
+}
+
+func checksumModeOrExit(s string) packet.ChecksumMode {
+	m, err := packet.ChecksumModeFromString(s)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return m
+}
+
+func portOrExit(port int) uint16 {
+	if port < 0 || port > 0xFFFF {
+		fmt.Printf("Bad port: %d\n", port)
+		os.Exit(1)
+	}
+	return uint16(port)
+}
+
+func vlanOrExit(vlan int) *uint16 {
+	if vlan < 0 {
+		return nil
+	}
+	if vlan > 0x0FFF {
+		fmt.Printf("Bad VLAN ID: %d\n", vlan)
+		os.Exit(1)
+	}
+	v := uint16(vlan)
+	return &v
+}
+
+func ipFromStringOrExit(ipString string) *pcap.IP {
 	if ipString == "" {
 		return nil
 	}
 
-	ip, err := pcap.IPv4FromString(ipString)
+	ip, err := pcap.IPFromString(ipString)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
@@ -45,33 +126,84 @@ func ipFromStringOrExit(ipString string) *pcap.IPv4 {
 }
 
 func main() {
+	parseArgs()
 	log.SetFlags(0)
 	log.Println("Pcap file name: ", args.pcapFname)
 	log.Println("Local IP: ", args.localIP)
 	log.Println("Remote IP: ", args.remoteIP)
-	file, err := os.Open(args.pcapFname)
+	log.Println("Local port: ", args.localPort)
+	log.Println("Remote port: ", args.remotePort)
+	if args.vlan != nil {
+		log.Println("VLAN: ", *args.vlan)
+	}
+	file, err := openInput(args.pcapFname, args.follow)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer file.Close()
 
+	if args.follow {
+		// On interrupt, finish with the records written so far, so the summaries are still printed.
+		interrupted := make(chan os.Signal, 1)
+		signal.Notify(interrupted, os.Interrupt)
+		go func() {
+			<-interrupted
+			log.Println("Interrupted, stopping following the file")
+			file.stopFollowing()
+			signal.Stop(interrupted)
+		}()
+	}
+
 	onPcapError := func(err error) bool {
 		log.Printf("Packet reading error: %s", err)
 		return true
 	}
 
-	// Load all the packets to memory. It can be easily converted to streaming.
-	packets, err := packet.LoadFromFile(file, onPcapError)
+	config := &flow.Config{
+		RTTMethod:     args.rttMethod,
+		Direction:     args.direction,
+		SplitSegments: args.splitGSO,
+	}
+	if args.eventsFname != "" {
+		events, err := os.Create(args.eventsFname)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer events.Close()
+		config.EventLog = events
+	}
+
+	// Packets are streamed, so memory does not depend on the size of the capture.
+	packets, err := packet.NewSource(file, args.checksums, onPcapError)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if args.statsMode {
 		// Stats mode.
-		stats.ProcessPackets(packets)
+		err = stats.ProcessPackets(packets, args.vlan)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if args.allMode {
+		// BDP mode for all the connections.
+		err = flow.ProcessAllPackets(packets, args.vlan, config)
+		if err != nil {
+			log.Fatal(err)
+		}
 	} else {
 		// BDP mode.
-		err = flow.ProcessPackets(packets, args.localIP, args.remoteIP)
+		if args.localIP == nil || args.remoteIP == nil {
+			log.Fatal("Local (-l) and remote (-r) IPs are required")
+		}
+		selector := &flow.Selector{
+			LocalIP:    *args.localIP,
+			RemoteIP:   *args.remoteIP,
+			LocalPort:  args.localPort,
+			RemotePort: args.remotePort,
+			VLAN:       args.vlan,
+		}
+		err = flow.ProcessPackets(packets, selector, config)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -0,0 +1,70 @@
+package packet
+
+import (
+	"fmt"
+	"jakub-m/bdp/pcap"
+)
+
+// ChecksumMode tells if and how the checksums of IPv4 headers and TCP segments are verified.
+type ChecksumMode int
+
+const (
+	// ChecksumOff does not verify the checksums.
+	ChecksumOff ChecksumMode = iota
+	// ChecksumStrict considers any checksum that does not match bad.
+	ChecksumStrict
+	// ChecksumOffload tolerates zero and partial checksums, which are in captures taken on the sending host when
+	// the NIC computes the checksums.
+	ChecksumOffload
+)
+
+func (m ChecksumMode) String() string {
+	switch m {
+	case ChecksumOff:
+		return "off"
+	case ChecksumStrict:
+		return "strict"
+	case ChecksumOffload:
+		return "offload"
+	}
+	return fmt.Sprintf("ChecksumMode(%d)", int(m))
+}
+
+// ChecksumModeFromString parses checksum mode name.
+func ChecksumModeFromString(s string) (ChecksumMode, error) {
+	for _, m := range []ChecksumMode{ChecksumOff, ChecksumStrict, ChecksumOffload} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown checksum mode: %s", s)
+}
+
+// verifyChecksums sets the checksum status of IP and TCP layers of the packet.
+func (p *Packet) verifyChecksums(mode ChecksumMode) {
+	if mode == ChecksumOff {
+		return
+	}
+	tolerateOffload := mode == ChecksumOffload
+	p.IPChecksum = p.IP.VerifyHeaderChecksum(tolerateOffload)
+	if p.TCP != nil {
+		p.TCPChecksum = p.TCP.VerifyChecksum(p.IP, tolerateOffload)
+	}
+}
+
+// Checksum sums up the checksum status of the packet: bad if any layer is bad, otherwise offloaded if any layer
+// is offloaded, otherwise good if any layer was verified.
+func (p *Packet) Checksum() pcap.ChecksumStatus {
+	status := pcap.ChecksumNotVerified
+	for _, s := range []pcap.ChecksumStatus{p.IPChecksum, p.TCPChecksum} {
+		switch {
+		case s == pcap.ChecksumBad:
+			return pcap.ChecksumBad
+		case s == pcap.ChecksumOffloaded:
+			status = pcap.ChecksumOffloaded
+		case s == pcap.ChecksumGood && status == pcap.ChecksumNotVerified:
+			status = pcap.ChecksumGood
+		}
+	}
+	return status
+}
@@ -6,73 +6,265 @@ import (
 	"jakub-m/bdp/pcap"
 )
 
+// Packet is decoded layer by layer. At most one of the transport layers (TCP, UDP or ICMP) is set, none of them if
+// the protocol is not decoded (e.g. GRE). IPChecksum and TCPChecksum are the outcome of the checksum verification,
+// see ChecksumMode.
 type Packet struct {
-	Record *pcap.PcapRecord
-	Ether  *pcap.Ether
-	IP     *pcap.IpPacket
-	TCP    *pcap.TcpPacket
+	Record      *pcap.PcapRecord
+	Link        *pcap.Link
+	IP          *pcap.IpPacket
+	TCP         *pcap.TcpPacket
+	UDP         *pcap.UdpPacket
+	ICMP        *pcap.IcmpPacket
+	IPChecksum  pcap.ChecksumStatus
+	TCPChecksum pcap.ChecksumStatus
 }
 
-// PayloadSize returns size of TCP payload.
-func (p *Packet) PayloadSize() uint16 {
-	return p.IP.TotalLength() - p.IP.HeaderLength() - p.TCP.HeaderSize()
+// Protocol is the IP protocol number of the transport layer.
+func (p *Packet) Protocol() uint8 {
+	return p.IP.Protocol()
+}
+
+// SourcePort is TCP or UDP source port, zero for other protocols.
+func (p *Packet) SourcePort() uint16 {
+	switch {
+	case p.TCP != nil:
+		return p.TCP.SourcePort()
+	case p.UDP != nil:
+		return p.UDP.SourcePort()
+	}
+	return 0
+}
+
+// DestPort is TCP or UDP destination port, zero for other protocols.
+func (p *Packet) DestPort() uint16 {
+	switch {
+	case p.TCP != nil:
+		return p.TCP.DestPort()
+	case p.UDP != nil:
+		return p.UDP.DestPort()
+	}
+	return 0
+}
+
+// maxFrameIPLength is the longest IP packet a link carries, with jumbo frames. Longer packets were captured before
+// TSO or GSO split them.
+const maxFrameIPLength = 9216
+
+// PayloadSize returns size of TCP or UDP payload, zero for other protocols. TCP payload size does not depend on the
+// bytes captured, so it is right for packets cut by the snap length. See ipLength.
+func (p *Packet) PayloadSize() uint32 {
+	switch {
+	case p.TCP != nil:
+		length, _ := p.ipLength()
+		headers := uint32(p.IP.HeaderLength()) + uint32(p.TCP.HeaderSize())
+		if length < headers {
+			return 0
+		}
+		return length - headers
+	case p.UDP != nil:
+		return uint32(p.UDP.PayloadLength())
+	}
+	return 0
+}
+
+// ipLength is the length of the IP packet. It is TotalLength of the header if it is valid. TSO and GSO segments
+// captured on the sending host may have TotalLength zero or bogus, then the length on the wire (OrigLen of the
+// record) is used, and fromHeader is false.
+func (p *Packet) ipLength() (length uint32, fromHeader bool) {
+	total := uint32(p.IP.TotalLength())
+	if p.IP.IsReassembled() {
+		// The record is the last fragment, so it is shorter than the whole packet.
+		return total, true
+	}
+	linkHeaderLength := uint32(len(p.Record.Data) - len(p.Link.Data))
+	if p.Record.OrigLen() < linkHeaderLength {
+		return total, true
+	}
+	wire := p.Record.OrigLen() - linkHeaderLength
+	if total >= uint32(p.IP.HeaderLength()) && total <= wire {
+		// TotalLength may be shorter than the frame, which is padded to the minimum size.
+		return total, true
+	}
+	return wire, false
+}
+
+// IsTruncated tells if the packet was cut by the snap length, so the payload was not captured whole.
+func (p *Packet) IsTruncated() bool {
+	return p.Record.IsTruncated()
+}
+
+// IsOversized tells if the packet is a TSO or GSO super-segment, i.e. captured on the sending host before the NIC or
+// the kernel split it into segments: its TotalLength is not valid, or it is longer than any link carries. Reassembled
+// packets are not, they were split into fragments on the wire.
+func (p *Packet) IsOversized() bool {
+	if p.IP.IsReassembled() {
+		return false
+	}
+	length, fromHeader := p.ipLength()
+	return !fromHeader || length > maxFrameIPLength
+}
+
+// VLANs returns VLAN IDs of the packet, from the outermost tag. It's empty for untagged or non-Ethernet packets.
+func (p *Packet) VLANs() []uint16 {
+	if p.Link.Ether == nil {
+		return nil
+	}
+	return p.Link.Ether.VLANs()
+}
+
+// HasVLAN tells if any of the VLAN tags of the packet has the given VLAN ID.
+func (p *Packet) HasVLAN(vlan uint16) bool {
+	for _, v := range p.VLANs() {
+		if v == vlan {
+			return true
+		}
+	}
+	return false
 }
 
 func (p *Packet) String() string {
-	return fmt.Sprintf("%dB %s %s", p.Record.OrigLen(), p.IP, p.TCP)
+	var transport fmt.Stringer
+	switch {
+	case p.TCP != nil:
+		transport = p.TCP
+	case p.UDP != nil:
+		transport = p.UDP
+	case p.ICMP != nil:
+		transport = p.ICMP
+	default:
+		return fmt.Sprintf("%dB %s %s%s", p.Record.OrigLen(), p.IP, pcap.ProtocolName(p.Protocol()), p.sizeFlags())
+	}
+	return fmt.Sprintf("%dB %s %s%s", p.Record.OrigLen(), p.IP, transport, p.sizeFlags())
+}
+
+func (p *Packet) sizeFlags() string {
+	flags := ""
+	if p.IsTruncated() {
+		flags += " truncated"
+	}
+	if p.IsOversized() {
+		flags += " oversized"
+	}
+	return flags
 }
 
 type processPacketFunc func(f *Packet) error
 
-// onError is called on packet read errors, return value is "should continue" - will break on false.
-func LoadFromFile(r io.Reader, onError func(error) bool) ([]*Packet, error) {
-	packets := []*Packet{}
+// Source yields packets one by one, so the capture does not need to fit in memory. Next returns io.EOF at
+// the end of the capture.
+type Source interface {
+	Next() (*Packet, error)
+}
+
+type recordSource struct {
+	reader      pcap.RecordReader
+	onError     func(error) bool
+	reassembler *reassembler
+	checksums   ChecksumMode
+}
 
-	p, err := pcap.NewPcap(r)
+// NewSource creates a streaming source of packets from a capture file (pcap or pcapng). checksums tells if the
+// checksums are verified. Packets with bad checksums are not dropped, they are flagged, see Packet.Checksum.
+// onError is called on packet read errors, return value is "should continue" - will break on false.
+func NewSource(r io.Reader, checksums ChecksumMode, onError func(error) bool) (Source, error) {
+	reader, err := pcap.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
+	return &recordSource{
+		reader:      reader,
+		onError:     onError,
+		reassembler: newReassembler(),
+		checksums:   checksums,
+	}, nil
+}
 
+func (s *recordSource) Next() (*Packet, error) {
 	for {
-		record, err := p.NextRecord()
-		if err == io.EOF {
-			return packets, nil
+		record, err := s.reader.NextRecord()
+		if err == io.ErrUnexpectedEOF {
+			// The last record is cut, e.g. the capture was interrupted. Treat it as the end of the capture.
+			if shouldContinue := s.onError(fmt.Errorf("Truncated last record: %s", err)); shouldContinue {
+				return nil, io.EOF
+			}
+			return nil, err
 		}
 		if err != nil {
 			return nil, err
 		}
 
-		packet, err := createPacketFromRecord(record)
+		link, ip, err := parseIPOfRecord(record)
+		if err == nil && ip.Fragment() != nil {
+			// Fragments are held until the whole packet is received, it is then attributed to the last fragment.
+			var errs []error
+			ip, errs = s.reassembler.add(ip, record.Timestamp())
+			for _, reassemblyErr := range errs {
+				if shouldContinue := s.onError(reassemblyErr); !shouldContinue {
+					return nil, reassemblyErr
+				}
+			}
+			if ip == nil {
+				continue
+			}
+		}
+		var packet *Packet
+		if err == nil {
+			packet, err = createPacket(record, link, ip)
+		}
 		if err != nil {
-			if shouldContinue := onError(err); shouldContinue {
+			if shouldContinue := s.onError(err); shouldContinue {
 				continue
 			}
 			return nil, err
 		}
-		packets = append(packets, packet)
+		packet.verifyChecksums(s.checksums)
+		return packet, nil
 	}
 }
 
-func createPacketFromRecord(record *pcap.PcapRecord) (*Packet, error) {
-	eth, err := pcap.ParseEtherPacket(record.Data)
+// parseIPOfRecord parses the link layer and the IP header of the record.
+func parseIPOfRecord(record *pcap.PcapRecord) (*pcap.Link, *pcap.IpPacket, error) {
+	link, err := pcap.ParseLinkLayer(record.LinkType(), record.Data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-
-	ip, err := pcap.ParseIPV4Packet(eth.Data)
-	if err != nil {
-		return nil, err
+	var ip *pcap.IpPacket
+	switch link.Protocol {
+	case pcap.EtherTypeIPv4:
+		ip, err = pcap.ParseIPV4Packet(link.Data)
+	case pcap.EtherTypeIPv6:
+		ip, err = pcap.ParseIPV6Packet(link.Data)
+	default:
+		return nil, nil, fmt.Errorf("Expected IP payload, got %#x", link.Protocol)
 	}
-
-	tcp, err := pcap.ParseTCPPacket(ip.Data)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return link, ip, nil
+}
 
-	return &Packet{
+// createPacket parses the transport layer of a whole (not fragmented, or reassembled) IP packet, according to the
+// protocol of the IP packet.
+func createPacket(record *pcap.PcapRecord, link *pcap.Link, ip *pcap.IpPacket) (*Packet, error) {
+	packet := &Packet{
 		Record: record,
-		Ether:  eth,
+		Link:   link,
 		IP:     ip,
-		TCP:    tcp,
-	}, nil
+	}
+	var err error
+	switch {
+	case ip.Protocol() == pcap.IPProtoTCP:
+		packet.TCP, err = pcap.ParseTCPPacket(ip.Data)
+	case ip.Protocol() == pcap.IPProtoUDP:
+		packet.UDP, err = pcap.ParseUDPPacket(ip.Data)
+	case ip.Protocol() == pcap.IPProtoICMP && ip.Version() == 4:
+		packet.ICMP, err = pcap.ParseICMPPacket(ip.Data)
+	case ip.Protocol() == pcap.IPProtoICMPv6 && ip.Version() == 6:
+		packet.ICMP, err = pcap.ParseICMPv6Packet(ip.Data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Bad %s packet: %s", pcap.ProtocolName(ip.Protocol()), err)
+	}
+	return packet, nil
 }
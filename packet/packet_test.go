@@ -0,0 +1,96 @@
+package packet
+
+import (
+	"encoding/binary"
+	"io"
+	"jakub-m/bdp/pcap/pcaptest"
+	"testing"
+)
+
+var (
+	testSrc = []byte{10, 0, 0, 1}
+	testDst = []byte{10, 0, 0, 2}
+)
+
+// buildTCPFrame builds an Ethernet frame of an IPv4 TCP segment with the given payload size. totalLength is written
+// to the IP header as is. fragment is the flags and the offset field of the IP header.
+func buildTCPFrame(totalLength, fragment uint16, payload int) []byte {
+	tcp := pcaptest.TCP(40000, 443, 1001, 5001, 0x10, nil, payload)
+	return pcaptest.Ethernet(pcaptest.IPv4(totalLength, 1, fragment, 6, testSrc, testDst, tcp))
+}
+
+// readTestPackets writes the records as a pcap file and decodes it.
+func readTestPackets(t *testing.T, records ...pcaptest.Record) []*Packet {
+	buf := pcaptest.Write(binary.LittleEndian, pcaptest.MagicMicro, records...)
+	source, err := NewSource(buf, ChecksumOff, func(err error) bool {
+		t.Fatal(err)
+		return false
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := []*Packet{}
+	for {
+		p, err := source.Next()
+		if err == io.EOF {
+			return packets
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		packets = append(packets, p)
+	}
+}
+
+func TestPacket_Whole(t *testing.T) {
+	packets := readTestPackets(t, pcaptest.Record{Data: buildTCPFrame(1500, 0x4000, 1460)})
+	p := packets[0]
+	assertEqual(t, p.PayloadSize(), uint32(1460))
+	assertEqual(t, p.IsTruncated(), false)
+	assertEqual(t, p.IsOversized(), false)
+	assertEqual(t, p.sizeFlags(), "")
+}
+
+func TestPacket_TruncatedBySnapLength(t *testing.T) {
+	packets := readTestPackets(t, pcaptest.Record{Data: buildTCPFrame(1500, 0x4000, 1460), CapLen: 200})
+	p := packets[0]
+	assertEqual(t, p.PayloadSize(), uint32(1460))
+	assertEqual(t, p.IsTruncated(), true)
+	assertEqual(t, p.IsOversized(), false)
+	assertEqual(t, p.sizeFlags(), " truncated")
+}
+
+func TestPacket_ZeroTotalLength(t *testing.T) {
+	// GSO super-segment captured on the sending host, the payload size is taken from the length on the wire.
+	packets := readTestPackets(t, pcaptest.Record{Data: buildTCPFrame(0, 0x4000, 30000), CapLen: 200})
+	p := packets[0]
+	assertEqual(t, p.PayloadSize(), uint32(30000))
+	assertEqual(t, p.IsTruncated(), true)
+	assertEqual(t, p.IsOversized(), true)
+	assertEqual(t, p.sizeFlags(), " truncated oversized")
+}
+
+func TestPacket_LongerThanLink(t *testing.T) {
+	packets := readTestPackets(t, pcaptest.Record{Data: buildTCPFrame(20040, 0x4000, 20000)})
+	p := packets[0]
+	assertEqual(t, p.PayloadSize(), uint32(20000))
+	assertEqual(t, p.IsTruncated(), false)
+	assertEqual(t, p.IsOversized(), true)
+}
+
+func TestPacket_ReassembledIsNotOversized(t *testing.T) {
+	segment := pcaptest.TCP(40000, 443, 1001, 5001, 0x10, nil, 20000)
+	fragment := func(fragment uint16, data []byte) pcaptest.Record {
+		return pcaptest.Record{Data: pcaptest.Ethernet(pcaptest.IPv4(uint16(20+len(data)), 1, fragment, 6, testSrc, testDst, data))}
+	}
+	packets := readTestPackets(t,
+		fragment(0x2000, segment[:8000]),
+		fragment(0x2000|1000, segment[8000:16000]),
+		fragment(2000, segment[16000:]),
+	)
+	assertEqual(t, len(packets), 1)
+	p := packets[0]
+	assertEqual(t, p.IP.IsReassembled(), true)
+	assertEqual(t, p.PayloadSize(), uint32(20000))
+	assertEqual(t, p.IsOversized(), false)
+}
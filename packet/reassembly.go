@@ -0,0 +1,192 @@
+package packet
+
+import (
+	"fmt"
+	"jakub-m/bdp/pcap"
+)
+
+const (
+	// fragmentTimeout is how long fragments wait for the rest of the packet, in capture time (as in Linux).
+	fragmentTimeout = 30 * 1000 * 1000 * 1000
+	// maxPendingPackets bounds the memory used by packets whose fragments never complete.
+	maxPendingPackets = 1024
+	// maxReassembledSize is the maximum size of IP payload.
+	maxReassembledSize = 0xFFFF
+)
+
+// fragmentKey identifies fragments of the same packet (RFC 791, RFC 8200).
+type fragmentKey struct {
+	source   pcap.IP
+	dest     pcap.IP
+	protocol uint8
+	id       uint32
+}
+
+// span is a range of the payload received, from start to end (exclusive).
+type span struct {
+	start, end int
+}
+
+// fragmentedPacket collects fragments of a single packet. first is the fragment with offset 0, its headers are
+// used for the reassembled packet. length is the length of the whole payload, known from the last fragment, -1
+// until then. received are the spans of the payload received, sorted and not overlapping. fragments are the
+// bounds of the fragments as they arrived, to tell duplicates from overlaps. extensionLength is the length of IPv6
+// extension headers at the start of the payload, which are already parsed in first.
+type fragmentedPacket struct {
+	first           *pcap.IpPacket
+	data            []byte
+	received        []span
+	fragments       []span
+	length          int
+	extensionLength int
+	firstSeen       uint64
+}
+
+// reassembler puts fragmented IP packets together. Overlapping fragments keep the data received first, except
+// for IPv6, where overlapping fragments make the whole packet invalid (RFC 5722). Packets that are not complete
+// within fragmentTimeout are dropped.
+type reassembler struct {
+	pending map[fragmentKey]*fragmentedPacket
+}
+
+func newReassembler() *reassembler {
+	return &reassembler{
+		pending: make(map[fragmentKey]*fragmentedPacket),
+	}
+}
+
+// add adds a fragment. It returns the reassembled packet if the fragment completes it, nil otherwise. Expired and
+// invalid packets are reported as errors, the reassembly goes on regardless.
+func (r *reassembler) add(ip *pcap.IpPacket, now uint64) (*pcap.IpPacket, []error) {
+	errs := r.expire(now)
+
+	fragment := ip.Fragment()
+	key := fragmentKey{
+		source:   ip.SourceIP(),
+		dest:     ip.DestIP(),
+		protocol: ip.Protocol(),
+		id:       fragment.ID,
+	}
+	if ip.Version() == 6 {
+		// Protocol of the non-first fragments is the next header of the fragment header, whatever the first
+		// fragment has after it.
+		key.protocol = fragment.NextHeader
+	}
+	p, ok := r.pending[key]
+	if !ok {
+		if len(r.pending) >= maxPendingPackets {
+			return nil, append(errs, fmt.Errorf("Too many fragmented packets pending, dropping fragment of %s > %s, id %d", key.source, key.dest, key.id))
+		}
+		p = &fragmentedPacket{length: -1, firstSeen: now}
+		r.pending[key] = p
+	}
+
+	if err := p.add(ip); err != nil {
+		delete(r.pending, key)
+		return nil, append(errs, err)
+	}
+	if !p.isComplete() {
+		return nil, errs
+	}
+	delete(r.pending, key)
+	return p.first.Reassembled(p.data[p.extensionLength:p.length]), errs
+}
+
+// expire drops the packets that wait for the fragments for too long.
+func (r *reassembler) expire(now uint64) []error {
+	var errs []error
+	for key, p := range r.pending {
+		// Records of multi-interface captures may go back in time, which does not expire anything.
+		if now > p.firstSeen && now-p.firstSeen > fragmentTimeout {
+			delete(r.pending, key)
+			errs = append(errs, fmt.Errorf("Reassembly of %s > %s, id %d timed out", key.source, key.dest, key.id))
+		}
+	}
+	return errs
+}
+
+func (p *fragmentedPacket) add(ip *pcap.IpPacket) error {
+	fragment := ip.Fragment()
+	payload := ip.Data[:ip.PayloadLength()]
+	if fragment.ExtensionLength > 0 {
+		// The extension headers after the fragment header are not in Data of the first fragment, only their space
+		// is kept.
+		payload = append(make([]byte, fragment.ExtensionLength), payload...)
+	}
+	start := int(fragment.Offset)
+	end := start + len(payload)
+	if end > maxReassembledSize {
+		return fmt.Errorf("Reassembled packet %s > %s, id %d too big", ip.SourceIP(), ip.DestIP(), fragment.ID)
+	}
+	if !fragment.MoreFragments {
+		if p.length >= 0 && p.length != end {
+			return fmt.Errorf("Conflicting last fragments of %s > %s, id %d", ip.SourceIP(), ip.DestIP(), fragment.ID)
+		}
+		p.length = end
+	}
+	for _, s := range p.fragments {
+		if s.start == start && s.end == end {
+			// Exact duplicate, e.g. sent twice by the link, the data received first is kept.
+			return nil
+		}
+		if ip.Version() == 6 && s.start < end && start < s.end {
+			return fmt.Errorf("Overlapping IPv6 fragments of %s > %s, id %d", ip.SourceIP(), ip.DestIP(), fragment.ID)
+		}
+	}
+	p.fragments = append(p.fragments, span{start, end})
+	if start == 0 {
+		p.first = ip
+		p.extensionLength = int(fragment.ExtensionLength)
+	}
+	if len(p.data) < end {
+		data := make([]byte, end)
+		copy(data, p.data)
+		p.data = data
+	}
+
+	// Copy only the parts not received yet, so the data received first wins.
+	pos := start
+	for _, s := range p.received {
+		if s.end <= pos || s.start >= end {
+			continue
+		}
+		if s.start > pos {
+			copy(p.data[pos:s.start], payload[pos-start:])
+		}
+		pos = s.end
+	}
+	if pos < end {
+		copy(p.data[pos:end], payload[pos-start:])
+	}
+	p.addSpan(span{start, end})
+	return nil
+}
+
+// addSpan adds the span to the received spans, merging the adjacent and overlapping ones.
+func (p *fragmentedPacket) addSpan(n span) {
+	merged := []span{}
+	for _, s := range p.received {
+		if s.end < n.start || s.start > n.end {
+			merged = append(merged, s)
+			continue
+		}
+		if s.start < n.start {
+			n.start = s.start
+		}
+		if s.end > n.end {
+			n.end = s.end
+		}
+	}
+	merged = append(merged, n)
+	// Keep the spans sorted, there are few of them.
+	for i := len(merged) - 1; i > 0 && merged[i].start < merged[i-1].start; i-- {
+		merged[i], merged[i-1] = merged[i-1], merged[i]
+	}
+	p.received = merged
+}
+
+// isComplete tells if the first and the last fragments were received, and there are no holes between them.
+func (p *fragmentedPacket) isComplete() bool {
+	return p.first != nil && p.length >= 0 && len(p.received) == 1 &&
+		p.received[0].start == 0 && p.received[0].end == p.length
+}
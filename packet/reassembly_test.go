@@ -0,0 +1,176 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"jakub-m/bdp/pcap"
+	"jakub-m/bdp/pcap/pcaptest"
+	"reflect"
+	"testing"
+)
+
+const testSecond = 1000 * 1000 * 1000
+
+func ipv4Fragment(t *testing.T, id uint16, offset int, more bool, payload []byte) *pcap.IpPacket {
+	fragment := uint16(offset / 8)
+	if more {
+		fragment |= 0x2000
+	}
+	ip, err := pcap.ParseIPV4Packet(pcaptest.IPv4(uint16(20+len(payload)), id, fragment, 17, testSrc, testDst, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip
+}
+
+func ipv6Fragment(t *testing.T, id uint32, offset int, more bool, payload []byte) *pcap.IpPacket {
+	return ipv6FragmentWithNextHeader(t, id, offset, more, 17, payload)
+}
+
+// ipv6FragmentWithNextHeader is an IPv6 fragment whose fragment header is followed by nextHeader.
+func ipv6FragmentWithNextHeader(t *testing.T, id uint32, offset int, more bool, nextHeader uint8, payload []byte) *pcap.IpPacket {
+	flags := uint16(offset)
+	if more {
+		flags |= 1
+	}
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, uint32(0x60000000))
+	binary.Write(buf, binary.BigEndian, uint16(8+len(payload)))
+	binary.Write(buf, binary.BigEndian, []uint8{44, 64})
+	buf.Write([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	buf.Write([]byte{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2})
+	binary.Write(buf, binary.BigEndian, []uint8{nextHeader, 0})
+	binary.Write(buf, binary.BigEndian, flags)
+	binary.Write(buf, binary.BigEndian, id)
+	buf.Write(payload)
+	ip, err := pcap.ParseIPV6Packet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip
+}
+
+// bytesOf returns n bytes of value b.
+func bytesOf(b byte, n int) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+// dataOf returns the payload of the reassembled packet, and fails the test if the packet was not reassembled.
+func dataOf(t *testing.T, ip *pcap.IpPacket) []byte {
+	t.Helper()
+	if ip == nil {
+		t.Fatal("Packet not reassembled")
+	}
+	return ip.Data
+}
+
+func assertEqual(t *testing.T, actual, expected interface{}) {
+	t.Helper()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v (%T), got %v (%T)", expected, expected, actual, actual)
+	}
+}
+
+func TestReassembler_OutOfOrder(t *testing.T) {
+	r := newReassembler()
+	ip, errs := r.add(ipv4Fragment(t, 1, 8, false, bytesOf(2, 4)), 0)
+	assertEqual(t, ip, (*pcap.IpPacket)(nil))
+	assertEqual(t, len(errs), 0)
+	ip, errs = r.add(ipv4Fragment(t, 1, 0, true, bytesOf(1, 8)), 0)
+	assertEqual(t, len(errs), 0)
+	assertEqual(t, dataOf(t, ip), append(bytesOf(1, 8), bytesOf(2, 4)...))
+	assertEqual(t, ip.TotalLength(), uint16(32))
+	assertEqual(t, ip.IsReassembled(), true)
+	assertEqual(t, len(r.pending), 0)
+}
+
+func TestReassembler_IPv4OverlapKeepsFirst(t *testing.T) {
+	r := newReassembler()
+	r.add(ipv4Fragment(t, 1, 0, true, bytesOf(1, 16)), 0)
+	r.add(ipv4Fragment(t, 1, 8, true, bytesOf(2, 16)), 0)
+	ip, errs := r.add(ipv4Fragment(t, 1, 24, false, bytesOf(3, 8)), 0)
+	assertEqual(t, len(errs), 0)
+	assertEqual(t, dataOf(t, ip), append(append(bytesOf(1, 16), bytesOf(2, 8)...), bytesOf(3, 8)...))
+}
+
+func TestReassembler_IPv6Overlap(t *testing.T) {
+	r := newReassembler()
+	r.add(ipv6Fragment(t, 1, 0, true, bytesOf(1, 16)), 0)
+	ip, errs := r.add(ipv6Fragment(t, 1, 8, false, bytesOf(2, 16)), 0)
+	assertEqual(t, ip, (*pcap.IpPacket)(nil))
+	assertEqual(t, len(errs), 1)
+	assertEqual(t, len(r.pending), 0)
+}
+
+func TestReassembler_IPv6Duplicate(t *testing.T) {
+	r := newReassembler()
+	r.add(ipv6Fragment(t, 1, 8, true, bytesOf(2, 8)), 0)
+	r.add(ipv6Fragment(t, 1, 16, false, bytesOf(3, 8)), 0)
+	// The duplicate is adjacent to the fragments received so far, it is not an overlap.
+	ip, errs := r.add(ipv6Fragment(t, 1, 16, false, bytesOf(3, 8)), 0)
+	assertEqual(t, ip, (*pcap.IpPacket)(nil))
+	assertEqual(t, len(errs), 0)
+	ip, errs = r.add(ipv6Fragment(t, 1, 0, true, bytesOf(1, 8)), 0)
+	assertEqual(t, len(errs), 0)
+	assertEqual(t, dataOf(t, ip), append(append(bytesOf(1, 8), bytesOf(2, 8)...), bytesOf(3, 8)...))
+}
+
+func TestReassembler_IPv6ExtensionHeaderAfterFragmentHeader(t *testing.T) {
+	const destOptions = 60
+	// Destination options with padding only, followed by UDP. They are a part of the fragmented payload.
+	options := []byte{17, 0, 1, 4, 0, 0, 0, 0}
+	r := newReassembler()
+	ip, errs := r.add(ipv6FragmentWithNextHeader(t, 1, 16, false, destOptions, bytesOf(2, 8)), 0)
+	assertEqual(t, ip, (*pcap.IpPacket)(nil))
+	assertEqual(t, len(errs), 0)
+	first := ipv6FragmentWithNextHeader(t, 1, 0, true, destOptions, append(options, bytesOf(1, 8)...))
+	assertEqual(t, first.Protocol(), uint8(17))
+	ip, errs = r.add(first, 0)
+	assertEqual(t, len(errs), 0)
+	assertEqual(t, dataOf(t, ip), append(bytesOf(1, 8), bytesOf(2, 8)...))
+	assertEqual(t, ip.Protocol(), uint8(17))
+	assertEqual(t, ip.PayloadLength(), 16)
+	assertEqual(t, len(r.pending), 0)
+}
+
+func TestReassembler_ConflictingLastFragments(t *testing.T) {
+	r := newReassembler()
+	r.add(ipv4Fragment(t, 1, 8, false, bytesOf(2, 8)), 0)
+	ip, errs := r.add(ipv4Fragment(t, 1, 16, false, bytesOf(3, 8)), 0)
+	assertEqual(t, ip, (*pcap.IpPacket)(nil))
+	assertEqual(t, len(errs), 1)
+	assertEqual(t, len(r.pending), 0)
+}
+
+func TestReassembler_Timeout(t *testing.T) {
+	r := newReassembler()
+	r.add(ipv4Fragment(t, 1, 0, true, bytesOf(1, 8)), 0)
+	_, errs := r.add(ipv4Fragment(t, 2, 0, true, bytesOf(1, 8)), 31*testSecond)
+	assertEqual(t, len(errs), 1)
+	ip, _ := r.add(ipv4Fragment(t, 1, 8, false, bytesOf(2, 8)), 31*testSecond)
+	assertEqual(t, ip, (*pcap.IpPacket)(nil))
+}
+
+func TestReassembler_EarlierRecordDoesNotExpire(t *testing.T) {
+	r := newReassembler()
+	r.add(ipv4Fragment(t, 1, 0, true, bytesOf(1, 8)), 10*testSecond)
+	_, errs := r.add(ipv4Fragment(t, 2, 0, true, bytesOf(1, 8)), 5*testSecond)
+	assertEqual(t, len(errs), 0)
+	ip, errs := r.add(ipv4Fragment(t, 1, 8, false, bytesOf(2, 8)), 10*testSecond)
+	assertEqual(t, len(errs), 0)
+	assertEqual(t, len(dataOf(t, ip)), 16)
+}
+
+func TestReassembler_MaxPendingPackets(t *testing.T) {
+	r := newReassembler()
+	for id := 0; id < maxPendingPackets; id++ {
+		_, errs := r.add(ipv4Fragment(t, uint16(id), 0, true, bytesOf(1, 8)), 0)
+		assertEqual(t, len(errs), 0)
+	}
+	_, errs := r.add(ipv4Fragment(t, maxPendingPackets, 0, true, bytesOf(1, 8)), 0)
+	assertEqual(t, len(errs), 1)
+	assertEqual(t, len(r.pending), maxPendingPackets)
+	// Fragments of the pending packets are still accepted.
+	ip, _ := r.add(ipv4Fragment(t, 0, 8, false, bytesOf(2, 8)), 0)
+	assertEqual(t, len(dataOf(t, ip)), 16)
+}
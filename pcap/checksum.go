@@ -0,0 +1,101 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ChecksumStatus is the outcome of checksum verification.
+type ChecksumStatus int
+
+const (
+	// ChecksumNotVerified is when the verification is off, or not possible, e.g. the packet was cut by the snap
+	// length, or it has no checksum (IPv6 header).
+	ChecksumNotVerified ChecksumStatus = iota
+	ChecksumGood
+	ChecksumBad
+	// ChecksumOffloaded is a zero or partial checksum left by checksum offload, in packets captured on the sending
+	// host. The NIC fills in the checksum after the packet is captured.
+	ChecksumOffloaded
+)
+
+func (s ChecksumStatus) String() string {
+	switch s {
+	case ChecksumNotVerified:
+		return "not verified"
+	case ChecksumGood:
+		return "good"
+	case ChecksumBad:
+		return "bad"
+	case ChecksumOffloaded:
+		return "offloaded"
+	}
+	return fmt.Sprintf("ChecksumStatus(%d)", int(s))
+}
+
+// onesComplementSum adds the data as 16 bit words to the sum, as in RFC 1071. The sum is not folded.
+func onesComplementSum(sum uint32, data []byte) uint32 {
+	for len(data) >= 2 {
+		sum += uint32(binary.BigEndian.Uint16(data))
+		data = data[2:]
+	}
+	if len(data) == 1 {
+		sum += uint32(data[0]) << 8
+	}
+	return sum
+}
+
+// fold folds the carries of the sum into 16 bits.
+func fold(sum uint32) uint16 {
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return uint16(sum)
+}
+
+// VerifyHeaderChecksum verifies the checksum of IPv4 header. With tolerateOffload, zero checksum is considered
+// offloaded rather than bad. For a reassembled packet the header of the first fragment is verified.
+func (f *IpPacket) VerifyHeaderChecksum(tolerateOffload bool) ChecksumStatus {
+	if f.hdr == nil || len(f.rawHeader) == 0 {
+		return ChecksumNotVerified
+	}
+	if tolerateOffload && f.hdr.HeaderChecksum == 0 {
+		return ChecksumOffloaded
+	}
+	// The sum of the whole header, including the checksum, is all ones.
+	if fold(onesComplementSum(0, f.rawHeader)) == 0xFFFF {
+		return ChecksumGood
+	}
+	return ChecksumBad
+}
+
+// pseudoHeaderSum is the sum of the pseudo-header that TCP and UDP checksums cover (RFC 793, RFC 8200).
+func (f *IpPacket) pseudoHeaderSum(length int) uint32 {
+	var sum uint32
+	if f.hdr6 != nil {
+		sum = onesComplementSum(sum, f.hdr6.SourceIP[:])
+		sum = onesComplementSum(sum, f.hdr6.DestIP[:])
+	} else {
+		sum = onesComplementSum(sum, f.hdr.SourceIP[:])
+		sum = onesComplementSum(sum, f.hdr.DestIP[:])
+	}
+	return sum + uint32(f.protocol) + uint32(length>>16) + uint32(length&0xFFFF)
+}
+
+// VerifyChecksum verifies the checksum of the TCP segment carried by ip. With tolerateOffload, zero checksum or
+// the sum of the pseudo-header alone (what Linux leaves for the NIC to complete) is considered offloaded rather than
+// bad. Segments cut by the snap length are not verified.
+func (f *TcpPacket) VerifyChecksum(ip *IpPacket, tolerateOffload bool) ChecksumStatus {
+	length := int(ip.TotalLength()) - int(ip.HeaderLength())
+	if length < tcpHdrSize || length > len(f.raw) {
+		return ChecksumNotVerified
+	}
+	pseudo := ip.pseudoHeaderSum(length)
+	if tolerateOffload && (f.hdr.Checksum == 0 || f.hdr.Checksum == fold(pseudo) || f.hdr.Checksum == ^fold(pseudo)) {
+		return ChecksumOffloaded
+	}
+	if fold(onesComplementSum(pseudo, f.raw[:length])) == 0xFFFF {
+		return ChecksumGood
+	}
+	return ChecksumBad
+}
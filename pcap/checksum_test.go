@@ -0,0 +1,62 @@
+package pcap_test
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+// checksummedSegment is IPv4 packet with TCP segment of 5 bytes of payload, both with good checksums.
+func checksummedSegment() []byte {
+	return []byte{
+		0x45, 0x00, 0x00, 0x2d, 0x00, 0x01, 0x40, 0x00, 0x40, 0x06, 0x26, 0xc8, // IP, checksum 0x26c8
+		0x0a, 0x00, 0x00, 0x01, 0x0a, 0x00, 0x00, 0x02,
+		0x9c, 0x40, 0x01, 0xbb, 0x00, 0x00, 0x03, 0xe8, 0x00, 0x00, 0x07, 0xd0, // TCP 40000 > 443
+		0x50, 0x18, 0x03, 0xe8, 0xc4, 0x62, 0x00, 0x00, // checksum 0xc462
+		0x61, 0x62, 0x63, 0x64, 0x65, // payload
+	}
+}
+
+func parseSegment(t *testing.T, raw []byte) (*pcap.IpPacket, *pcap.TcpPacket) {
+	ip, err := pcap.ParseIPV4Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := pcap.ParseTCPPacket(ip.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ip, tcp
+}
+
+func TestVerifyChecksum_Good(t *testing.T) {
+	ip, tcp := parseSegment(t, checksummedSegment())
+	assertEqual(t, ip.VerifyHeaderChecksum(false), pcap.ChecksumGood)
+	assertEqual(t, tcp.VerifyChecksum(ip, false), pcap.ChecksumGood)
+	assertEqual(t, tcp.VerifyChecksum(ip, true), pcap.ChecksumGood)
+}
+
+func TestVerifyChecksum_Corrupted(t *testing.T) {
+	raw := checksummedSegment()
+	raw[8] = 63   // TTL
+	raw[42] = 'x' // payload
+	ip, tcp := parseSegment(t, raw)
+	assertEqual(t, ip.VerifyHeaderChecksum(true), pcap.ChecksumBad)
+	assertEqual(t, tcp.VerifyChecksum(ip, true), pcap.ChecksumBad)
+}
+
+func TestVerifyChecksum_Offloaded(t *testing.T) {
+	raw := checksummedSegment()
+	raw[10], raw[11] = 0, 0
+	// Linux leaves the sum of the pseudo-header for the NIC.
+	raw[36], raw[37] = 0x14, 0x22
+	ip, tcp := parseSegment(t, raw)
+	assertEqual(t, ip.VerifyHeaderChecksum(false), pcap.ChecksumBad)
+	assertEqual(t, ip.VerifyHeaderChecksum(true), pcap.ChecksumOffloaded)
+	assertEqual(t, tcp.VerifyChecksum(ip, false), pcap.ChecksumBad)
+	assertEqual(t, tcp.VerifyChecksum(ip, true), pcap.ChecksumOffloaded)
+}
+
+func TestVerifyChecksum_Truncated(t *testing.T) {
+	ip, tcp := parseSegment(t, checksummedSegment()[:42])
+	assertEqual(t, tcp.VerifyChecksum(ip, false), pcap.ChecksumNotVerified)
+}
@@ -0,0 +1,181 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// https://en.wikipedia.org/wiki/Internet_Control_Message_Protocol
+// RestOfHeader depends on the type, e.g. it has MTU of the next hop for "fragmentation needed".
+type icmpHdr struct {
+	Type         uint8
+	Code         uint8
+	Checksum     uint16
+	RestOfHeader uint32
+}
+
+const icmpHdrSize = 8
+
+// Types and codes of ICMP and ICMPv6 messages about the path of a packet.
+const (
+	ICMPTypeDestUnreachable = 3
+	ICMPTypeTimeExceeded    = 11
+	ICMPCodeFragNeeded      = 4
+
+	ICMPv6TypeDestUnreachable = 1
+	ICMPv6TypePacketTooBig    = 2
+	ICMPv6TypeTimeExceeded    = 3
+)
+
+// quotedTransportSize is the length of the transport header quoted in ICMP errors, at least (RFC 792).
+const quotedTransportSize = 8
+
+// IcmpPacket is either ICMP (for IPv4) or ICMPv6 message, Version tells which one.
+type IcmpPacket struct {
+	hdr     *icmpHdr
+	version uint8
+	Data    []byte
+}
+
+// Version is the IP version the message is for, 4 for ICMP and 6 for ICMPv6.
+func (f *IcmpPacket) Version() uint8 {
+	return f.version
+}
+
+func (f *IcmpPacket) Type() uint8 {
+	return f.hdr.Type
+}
+
+func (f *IcmpPacket) Code() uint8 {
+	return f.hdr.Code
+}
+
+// RestOfHeader is the last 4 bytes of the header, their meaning depends on the type.
+func (f *IcmpPacket) RestOfHeader() uint32 {
+	return f.hdr.RestOfHeader
+}
+
+func (f *IcmpPacket) String() string {
+	name := "ICMP"
+	if f.version == 6 {
+		name = "ICMPv6"
+	}
+	return fmt.Sprintf("%s {type %d, code %d}", name, f.hdr.Type, f.hdr.Code)
+}
+
+// ParseICMPPacket parses ICMP message carried in IPv4.
+func ParseICMPPacket(raw []byte) (*IcmpPacket, error) {
+	return parseICMP(raw, 4)
+}
+
+// ParseICMPv6Packet parses ICMPv6 message carried in IPv6.
+func ParseICMPv6Packet(raw []byte) (*IcmpPacket, error) {
+	return parseICMP(raw, 6)
+}
+
+func parseICMP(raw []byte, version uint8) (*IcmpPacket, error) {
+	reader := bytes.NewReader(raw)
+	header := &icmpHdr{}
+	err := binary.Read(reader, binary.BigEndian, header)
+	if err != nil {
+		return nil, err
+	}
+	return &IcmpPacket{
+		hdr:     header,
+		version: version,
+		Data:    raw[icmpHdrSize:],
+	}, nil
+}
+
+// IsPathError tells if the message reports a problem with a packet on its path (destination unreachable,
+// fragmentation needed or packet too big, time exceeded). Such messages quote the beginning of the packet.
+func (f *IcmpPacket) IsPathError() bool {
+	if f.version == 6 {
+		return f.hdr.Type == ICMPv6TypeDestUnreachable || f.hdr.Type == ICMPv6TypePacketTooBig ||
+			f.hdr.Type == ICMPv6TypeTimeExceeded
+	}
+	return f.hdr.Type == ICMPTypeDestUnreachable || f.hdr.Type == ICMPTypeTimeExceeded
+}
+
+// IsPacketTooBig tells if the message is "fragmentation needed" (ICMP) or "packet too big" (ICMPv6), so MTU tells
+// the MTU of the next hop.
+func (f *IcmpPacket) IsPacketTooBig() bool {
+	if f.version == 6 {
+		return f.hdr.Type == ICMPv6TypePacketTooBig
+	}
+	return f.hdr.Type == ICMPTypeDestUnreachable && f.hdr.Code == ICMPCodeFragNeeded
+}
+
+// MTU is the MTU of the next hop, for "fragmentation needed" and "packet too big" messages (RFC 1191, RFC 8201).
+func (f *IcmpPacket) MTU() uint32 {
+	if f.version == 6 {
+		return f.hdr.RestOfHeader
+	}
+	return f.hdr.RestOfHeader & 0xFFFF
+}
+
+// icmpUnreachable and icmpv6Unreachable name the codes of "destination unreachable" messages (RFC 792, RFC 4443).
+var (
+	icmpUnreachable   = []string{"net unreachable", "host unreachable", "protocol unreachable", "port unreachable"}
+	icmpv6Unreachable = []string{"no route", "administratively prohibited", "beyond scope", "address unreachable", "port unreachable"}
+)
+
+// Description names the message, e.g. "port unreachable".
+func (f *IcmpPacket) Description() string {
+	if f.IsPacketTooBig() {
+		if f.version == 6 {
+			return "packet too big"
+		}
+		return "fragmentation needed"
+	}
+	unreachable, timeExceeded, names := uint8(ICMPTypeDestUnreachable), uint8(ICMPTypeTimeExceeded), icmpUnreachable
+	if f.version == 6 {
+		unreachable, timeExceeded, names = ICMPv6TypeDestUnreachable, ICMPv6TypeTimeExceeded, icmpv6Unreachable
+	}
+	switch f.hdr.Type {
+	case unreachable:
+		if int(f.hdr.Code) < len(names) {
+			return names[f.hdr.Code]
+		}
+		return fmt.Sprintf("destination unreachable (code %d)", f.hdr.Code)
+	case timeExceeded:
+		return "time exceeded"
+	}
+	return fmt.Sprintf("type %d code %d", f.hdr.Type, f.hdr.Code)
+}
+
+// QuotedPacket is the beginning of the packet an ICMP error is about: the IP header and the first bytes of the
+// transport header, that is ports and, for TCP, the sequence number.
+type QuotedPacket struct {
+	IP         *IpPacket
+	SourcePort uint16
+	DestPort   uint16
+	SeqNum     SeqNum
+}
+
+// Quoted parses the packet quoted by an ICMP error.
+func (f *IcmpPacket) Quoted() (*QuotedPacket, error) {
+	if !f.IsPathError() {
+		return nil, fmt.Errorf("ICMP message %s does not quote a packet", f)
+	}
+	var ip *IpPacket
+	var err error
+	if f.version == 6 {
+		ip, err = ParseIPV6Packet(f.Data)
+	} else {
+		ip, err = ParseIPV4Packet(f.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(ip.Data) < quotedTransportSize {
+		return nil, fmt.Errorf("Quoted packet too short, %d bytes of transport header", len(ip.Data))
+	}
+	return &QuotedPacket{
+		IP:         ip,
+		SourcePort: binary.BigEndian.Uint16(ip.Data[0:]),
+		DestPort:   binary.BigEndian.Uint16(ip.Data[2:]),
+		SeqNum:     SeqNum(binary.BigEndian.Uint32(ip.Data[4:])),
+	}, nil
+}
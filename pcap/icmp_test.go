@@ -0,0 +1,79 @@
+package pcap_test
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+func TestParseICMPPacket(t *testing.T) {
+	raw := []byte{
+		3, 4, 0, 0, // destination unreachable, fragmentation needed, checksum
+		0, 0, 0x05, 0x78, // next hop MTU 1400
+		0x45, 0, 0, 40, // original IP header...
+	}
+	icmp, err := pcap.ParseICMPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, icmp.Version(), uint8(4))
+	assertEqual(t, icmp.Type(), uint8(3))
+	assertEqual(t, icmp.Code(), uint8(4))
+	assertEqual(t, icmp.RestOfHeader(), uint32(1400))
+	assertEqual(t, len(icmp.Data), 4)
+}
+
+func TestParseICMPv6Packet_Truncated(t *testing.T) {
+	_, err := pcap.ParseICMPv6Packet([]byte{2, 0, 0})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestIcmpPacket_Quoted(t *testing.T) {
+	raw := []byte{
+		3, 4, 0, 0, // destination unreachable, fragmentation needed, checksum
+		0, 0, 0x05, 0x78, // next hop MTU 1400
+		0x45, 0, 0x05, 0xdc, 0, 1, 0x40, 0, 64, 6, 0, 0, // original IP header, 1500 bytes, DF, TCP
+		10, 0, 0, 1, // source
+		10, 0, 0, 2, // dest
+		0x9c, 0x40, 0x01, 0xbb, // ports 40000 > 443
+		0, 0, 0x03, 0xe9, // seq 1001
+	}
+	icmp, err := pcap.ParseICMPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, icmp.IsPathError(), true)
+	assertEqual(t, icmp.IsPacketTooBig(), true)
+	assertEqual(t, icmp.MTU(), uint32(1400))
+	assertEqual(t, icmp.Description(), "fragmentation needed")
+	quoted, err := icmp.Quoted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, quoted.IP.Protocol(), uint8(pcap.IPProtoTCP))
+	assertEqual(t, quoted.IP.SourceIP().String(), "10.0.0.1")
+	assertEqual(t, quoted.IP.DestIP().String(), "10.0.0.2")
+	assertEqual(t, quoted.SourcePort, uint16(40000))
+	assertEqual(t, quoted.DestPort, uint16(443))
+	assertEqual(t, quoted.SeqNum, pcap.SeqNum(1001))
+}
+
+func TestIcmpPacket_QuotedTruncated(t *testing.T) {
+	raw := []byte{
+		11, 0, 0, 0, // time exceeded
+		0, 0, 0, 0,
+		0x45, 0, 0, 40, 0, 1, 0, 0, 1, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2,
+		0x9c, 0x40, // only the source port
+	}
+	icmp, err := pcap.ParseICMPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, icmp.IsPathError(), true)
+	assertEqual(t, icmp.IsPacketTooBig(), false)
+	_, err = icmp.Quoted()
+	if err == nil {
+		t.Fail()
+	}
+}
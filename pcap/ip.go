@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"net"
 	"strconv"
 	"strings"
 )
@@ -30,6 +31,25 @@ func (h *ipHdr) headerLength() uint8 {
 	return (h.Version_IHL & 0x0F) * 4
 }
 
+const (
+	ipv4FlagMoreFragments  = 0x2000
+	ipv4FragmentOffsetMask = 0x1FFF
+)
+
+// fragment returns fragment details, nil if the packet is not fragmented.
+func (h *ipHdr) fragment() *Fragment {
+	offset := (h.Flags_FragmentOffset & ipv4FragmentOffsetMask) * 8
+	more := h.Flags_FragmentOffset&ipv4FlagMoreFragments != 0
+	if offset == 0 && !more {
+		return nil
+	}
+	return &Fragment{
+		ID:            uint32(h.Identification),
+		Offset:        offset,
+		MoreFragments: more,
+	}
+}
+
 type IPv4 [4]uint8
 
 func IPv4FromString(in string) (IPv4, error) {
@@ -52,29 +72,193 @@ func (p IPv4) String() string {
 	return fmt.Sprintf("%d.%d.%d.%d", p[0], p[1], p[2], p[3])
 }
 
+// IP converts the address to the family-agnostic form.
+func (p IPv4) IP() IP {
+	ip := IP{}
+	copy(ip[:], ipv4MappedPrefix)
+	copy(ip[12:], p[:])
+	return ip
+}
+
+var ipv4MappedPrefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xFF, 0xFF}
+
+// IP is either IPv4 or IPv6 address. IPv4 addresses are kept in IPv4-mapped IPv6 form (::ffff:a.b.c.d), so
+// the addresses of both families can be compared and used as map keys.
+type IP [16]uint8
+
+// IPFromString parses IPv4 (dotted quad) or IPv6 address.
+func IPFromString(in string) (IP, error) {
+	if !strings.Contains(in, ":") {
+		ip, err := IPv4FromString(in)
+		if err != nil {
+			return IP{}, err
+		}
+		return ip.IP(), nil
+	}
+	parsed := net.ParseIP(in)
+	if parsed == nil {
+		return IP{}, fmt.Errorf("Bad IP: %s", in)
+	}
+	ip := IP{}
+	copy(ip[:], parsed.To16())
+	return ip, nil
+}
+
+// Is4 tells if the address is IPv4 address.
+func (p IP) Is4() bool {
+	return bytes.Equal(p[:12], ipv4MappedPrefix)
+}
+
+func (p IP) String() string {
+	return net.IP(p[:]).String()
+}
+
+// IP protocol numbers of the transport layer, as in Protocol.
+const (
+	IPProtoICMP   = 1
+	IPProtoTCP    = 6
+	IPProtoUDP    = 17
+	IPProtoGRE    = 47
+	IPProtoICMPv6 = 58
+)
+
+// ProtocolName returns the name of the IP protocol number, or the number if the protocol is not known.
+func ProtocolName(protocol uint8) string {
+	switch protocol {
+	case IPProtoICMP:
+		return "icmp"
+	case IPProtoTCP:
+		return "tcp"
+	case IPProtoUDP:
+		return "udp"
+	case IPProtoGRE:
+		return "gre"
+	case IPProtoICMPv6:
+		return "icmpv6"
+	}
+	return fmt.Sprintf("%d", protocol)
+}
+
+// Fragment tells where the payload of a fragment belongs in the payload of the original packet. ID is IPv4
+// identification, or identification from IPv6 fragment header. Offset is in bytes. NextHeader is the next header
+// of IPv6 fragment header, which is the same in all the fragments of a packet, unlike Protocol. ExtensionLength is
+// the length of IPv6 extension headers after the fragment header of the first fragment, they are a part of the
+// fragmented payload (RFC 8200).
+type Fragment struct {
+	ID              uint32
+	Offset          uint16
+	MoreFragments   bool
+	NextHeader      uint8
+	ExtensionLength uint16
+}
+
 type IpPacket struct {
 	hdr  *ipHdr
-	Data []byte
+	hdr6 *ipv6Hdr
+	// protocol and headerLength are from IPv4 header, or from the last IPv6 extension header.
+	protocol     uint8
+	headerLength uint16
+	fragment     *Fragment
+	reassembled  bool
+	// rawHeader is IPv4 header as captured, for the checksum verification.
+	rawHeader []byte
+	Data      []byte
 }
 
-func (f *IpPacket) SourceIP() IPv4 {
-	return f.hdr.SourceIP
+func (f *IpPacket) Version() uint8 {
+	if f.hdr6 != nil {
+		return 6
+	}
+	return 4
 }
 
-func (f *IpPacket) DestIP() IPv4 {
-	return f.hdr.DestIP
+func (f *IpPacket) SourceIP() IP {
+	if f.hdr6 != nil {
+		return f.hdr6.SourceIP
+	}
+	return f.hdr.SourceIP.IP()
 }
 
+func (f *IpPacket) DestIP() IP {
+	if f.hdr6 != nil {
+		return f.hdr6.DestIP
+	}
+	return f.hdr.DestIP.IP()
+}
+
+// TotalLength is the length of the whole IP packet, including headers.
 func (f *IpPacket) TotalLength() uint16 {
+	if f.hdr6 != nil {
+		return ipv6HdrSize + f.hdr6.PayloadLength
+	}
 	return f.hdr.TotalLength
 }
 
+// HeaderLength is the length of IP header. For IPv6 it includes the extension headers.
 func (f *IpPacket) HeaderLength() uint16 {
-	return uint16(f.hdr.headerLength())
+	return f.headerLength
+}
+
+// Protocol is the protocol of the payload. For IPv6 this is the next header of the last extension header.
+func (f *IpPacket) Protocol() uint8 {
+	return f.protocol
+}
+
+// Fragment returns where the payload belongs in the original packet, nil if the packet is not fragmented.
+func (f *IpPacket) Fragment() *Fragment {
+	return f.fragment
+}
+
+// PayloadLength is the length of the payload as stated in the header, which may be shorter than Data if the frame
+// was padded.
+func (f *IpPacket) PayloadLength() int {
+	length := int(f.TotalLength()) - int(f.headerLength)
+	if length < 0 {
+		return 0
+	}
+	if length > len(f.Data) {
+		return len(f.Data)
+	}
+	return length
+}
+
+// IsReassembled tells if the packet was put together from fragments.
+func (f *IpPacket) IsReassembled() bool {
+	return f.reassembled
+}
+
+// Reassembled returns the packet with the headers of f (the first fragment) and the whole reassembled payload.
+func (f *IpPacket) Reassembled(payload []byte) *IpPacket {
+	reassembled := *f
+	reassembled.fragment = nil
+	reassembled.reassembled = true
+	reassembled.Data = payload
+	if f.hdr6 != nil {
+		hdr6 := *f.hdr6
+		hdr6.PayloadLength = uint16(int(f.headerLength) - ipv6HdrSize + len(payload))
+		reassembled.hdr6 = &hdr6
+	} else {
+		hdr := *f.hdr
+		hdr.TotalLength = uint16(int(f.headerLength) + len(payload))
+		hdr.Flags_FragmentOffset &^= ipv4FlagMoreFragments | ipv4FragmentOffsetMask
+		reassembled.hdr = &hdr
+	}
+	return &reassembled
 }
 
 func (f *IpPacket) String() string {
-	return fmt.Sprintf("IP {Ver %d, hdr len %d, %s -> %s, data=%d}", f.hdr.version(), f.hdr.headerLength(), f.hdr.SourceIP.String(), f.hdr.DestIP.String(), len(f.Data))
+	return fmt.Sprintf("IP {Ver %d, hdr len %d, %s -> %s, data=%d}", f.Version(), f.HeaderLength(), f.SourceIP(), f.DestIP(), len(f.Data))
+}
+
+// ParseIPPacket parses either IPv4 or IPv6 packet, depending on the version field.
+func ParseIPPacket(raw []byte) (*IpPacket, error) {
+	if len(raw) < 1 {
+		return nil, fmt.Errorf("Empty IP packet")
+	}
+	if raw[0]>>4 == 6 {
+		return ParseIPV6Packet(raw)
+	}
+	return ParseIPV4Packet(raw)
 }
 
 func ParseIPV4Packet(raw []byte) (*IpPacket, error) {
@@ -88,9 +272,16 @@ func ParseIPV4Packet(raw []byte) (*IpPacket, error) {
 	if header.version() != 4 {
 		return nil, fmt.Errorf("Expected IP version 4 , got %#x", header.version())
 	}
+	if int(header.headerLength()) > len(raw) {
+		return nil, fmt.Errorf("IP header length %d exceeds packet size %d", header.headerLength(), len(raw))
+	}
 
 	return &IpPacket{
-		hdr:  header,
-		Data: raw[header.headerLength():],
+		hdr:          header,
+		protocol:     header.Protocol,
+		headerLength: uint16(header.headerLength()),
+		fragment:     header.fragment(),
+		rawHeader:    raw[:header.headerLength()],
+		Data:         raw[header.headerLength():],
 	}, nil
 }
@@ -0,0 +1,124 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	ipv6HdrSize = 40
+
+	ipProtoHopByHop    = 0
+	ipProtoRouting     = 43
+	ipProtoFragment    = 44
+	ipProtoAH          = 51
+	ipProtoDestOptions = 60
+	ipProtoMobility    = 135
+	ipProtoHIP         = 139
+	ipProtoShim6       = 140
+
+	ipv6FragmentHdrSize = 8
+)
+
+// https://en.wikipedia.org/wiki/IPv6_packet
+type ipv6Hdr struct {
+	Version_TrafficClass_FlowLabel uint32
+	PayloadLength                  uint16
+	NextHeader                     uint8
+	HopLimit                       uint8
+	SourceIP                       IP
+	DestIP                         IP
+}
+
+func (h *ipv6Hdr) version() uint8 {
+	return uint8(h.Version_TrafficClass_FlowLabel >> 28)
+}
+
+// ParseIPV6Packet parses IPv6 header and walks the extension headers, so Data is the upper layer payload
+// (e.g. TCP segment).
+func ParseIPV6Packet(raw []byte) (*IpPacket, error) {
+	reader := bytes.NewReader(raw)
+	header := &ipv6Hdr{}
+	err := binary.Read(reader, binary.BigEndian, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if header.version() != 6 {
+		return nil, fmt.Errorf("Expected IP version 6 , got %#x", header.version())
+	}
+
+	protocol, headerLength, fragment, err := walkIPv6ExtensionHeaders(header.NextHeader, raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IpPacket{
+		hdr6:         header,
+		protocol:     protocol,
+		headerLength: uint16(headerLength),
+		fragment:     fragment,
+		Data:         raw[headerLength:],
+	}, nil
+}
+
+// walkIPv6ExtensionHeaders skips the extension headers and returns the upper layer protocol and the offset
+// of its header. If there is a fragment header, the fragment details are returned too. The walk stops at the
+// fragment header of a non-first fragment, since what follows is a part of the payload.
+func walkIPv6ExtensionHeaders(nextHeader uint8, raw []byte) (protocol uint8, offset int, fragment *Fragment, err error) {
+	offset = ipv6HdrSize
+	// fragmentEnd is the offset following the fragment header.
+	fragmentEnd := 0
+	for {
+		var length int
+		switch nextHeader {
+		case ipProtoHopByHop, ipProtoRouting, ipProtoDestOptions, ipProtoMobility, ipProtoHIP, ipProtoShim6:
+			if len(raw) < offset+2 {
+				return 0, 0, nil, fmt.Errorf("Truncated IPv6 extension header %d", nextHeader)
+			}
+			length = (int(raw[offset+1]) + 1) * 8
+		case ipProtoFragment:
+			length = ipv6FragmentHdrSize
+		case ipProtoAH:
+			if len(raw) < offset+2 {
+				return 0, 0, nil, fmt.Errorf("Truncated IPv6 authentication header")
+			}
+			length = (int(raw[offset+1]) + 2) * 4
+		default:
+			// Upper layer protocol (or no next header), the walk is done.
+			if fragment != nil {
+				fragment.ExtensionLength = uint16(offset - fragmentEnd)
+			}
+			return nextHeader, offset, fragment, nil
+		}
+		if len(raw) < offset+length {
+			return 0, 0, nil, fmt.Errorf("Truncated IPv6 extension header %d", nextHeader)
+		}
+		if nextHeader == ipProtoFragment {
+			fragment = parseIPv6FragmentHeader(raw[offset : offset+length])
+			if fragment != nil && fragment.Offset != 0 {
+				return raw[offset], offset + length, fragment, nil
+			}
+			fragmentEnd = offset + length
+		}
+		nextHeader = raw[offset]
+		offset += length
+	}
+}
+
+// parseIPv6FragmentHeader returns the fragment details, nil for atomic fragment (RFC 6946), that is a whole
+// packet with a fragment header.
+func parseIPv6FragmentHeader(hdr []byte) *Fragment {
+	offsetFlags := binary.BigEndian.Uint16(hdr[2:])
+	fragment := &Fragment{
+		ID:            binary.BigEndian.Uint32(hdr[4:]),
+		Offset:        offsetFlags &^ 0x7,
+		MoreFragments: offsetFlags&0x1 != 0,
+		NextHeader:    hdr[0],
+	}
+	if fragment.Offset == 0 && !fragment.MoreFragments {
+		return nil
+	}
+	return fragment
+}
@@ -0,0 +1,181 @@
+package pcap_test
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+func TestIPFromString_IPv4(t *testing.T) {
+	ip, err := pcap.IPFromString("1.0.2.255")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ip, pcap.IPv4([4]byte{1, 0, 2, 255}).IP())
+	assertEqual(t, ip.Is4(), true)
+	assertEqual(t, ip.String(), "1.0.2.255")
+}
+
+func TestIPFromString_IPv6(t *testing.T) {
+	ip, err := pcap.IPFromString("2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ip.Is4(), false)
+	assertEqual(t, ip.String(), "2001:db8::1")
+}
+
+func TestIPFromString_Bad(t *testing.T) {
+	_, err := pcap.IPFromString("2001:db8::1::2")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseIPV6Packet_ExtensionHeaders(t *testing.T) {
+	raw := []byte{
+		0x60, 0, 0, 0, // version, traffic class, flow label
+		0, 20, // payload length
+		0,  // next header: hop-by-hop
+		64, // hop limit
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		// hop-by-hop, next header: destination options, 8 bytes
+		60, 0, 1, 4, 0, 0, 0, 0,
+		// destination options, next header: TCP, 8 bytes
+		6, 0, 1, 4, 0, 0, 0, 0,
+		// payload
+		1, 2, 3, 4,
+	}
+	ip, err := pcap.ParseIPV6Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ip.Version(), uint8(6))
+	assertEqual(t, ip.Protocol(), uint8(6))
+	assertEqual(t, ip.HeaderLength(), uint16(56))
+	assertEqual(t, ip.TotalLength(), uint16(60))
+	assertEqual(t, len(ip.Data), 4)
+	assertEqual(t, ip.SourceIP().String(), "2001:db8::1")
+	assertEqual(t, ip.DestIP().String(), "2001:db8::2")
+}
+
+func TestParseIPV6Packet_TruncatedExtensionHeader(t *testing.T) {
+	raw := make([]byte, 42)
+	raw[0] = 0x60
+	raw[6] = 43 // routing header
+	raw[41] = 2 // 24 bytes, more than available
+	_, err := pcap.ParseIPV6Packet(raw)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseIPV6Packet_NonFirstFragment(t *testing.T) {
+	raw := []byte{
+		0x60, 0, 0, 0,
+		0, 12, // payload length
+		44, // next header: fragment
+		64,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		// fragment, next header: TCP, offset 1480, no more fragments, id
+		6, 0, 0x05, 0xC8, 0, 0, 0x12, 0x34,
+		// payload, not a TCP header
+		1, 2, 3, 4,
+	}
+	ip, err := pcap.ParseIPV6Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ip.Protocol(), uint8(6))
+	assertEqual(t, ip.HeaderLength(), uint16(48))
+	assertEqual(t, *ip.Fragment(), pcap.Fragment{ID: 0x1234, Offset: 1480, MoreFragments: false, NextHeader: 6})
+	assertEqual(t, ip.PayloadLength(), 4)
+}
+
+func TestParseIPV6Packet_AtomicFragment(t *testing.T) {
+	raw := []byte{
+		0x60, 0, 0, 0,
+		0, 12,
+		44,
+		64,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		// fragment, offset 0, no more fragments
+		6, 0, 0, 0, 0, 0, 0x12, 0x34,
+		1, 2, 3, 4,
+	}
+	ip, err := pcap.ParseIPV6Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip.Fragment() != nil {
+		t.Fatal(ip.Fragment())
+	}
+}
+
+func TestIpPacket_Reassembled(t *testing.T) {
+	raw := []byte{
+		0x60, 0, 0, 0,
+		0, 12,
+		44,
+		64,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		// fragment, offset 0, more fragments
+		6, 0, 0, 1, 0, 0, 0x12, 0x34,
+		1, 2, 3, 4,
+	}
+	ip, err := pcap.ParseIPV6Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ip.IsReassembled(), false)
+	reassembled := ip.Reassembled(make([]byte, 100))
+	assertEqual(t, reassembled.IsReassembled(), true)
+	assertEqual(t, reassembled.Fragment(), (*pcap.Fragment)(nil))
+	assertEqual(t, reassembled.TotalLength(), uint16(148))
+	assertEqual(t, reassembled.PayloadLength(), 100)
+}
+
+func TestParseIPV4Packet_Fragment(t *testing.T) {
+	raw := []byte{
+		0x45, 0, 0, 24, // version, IHL, DSCP, total length
+		0x12, 0x34, 0x20, 0x02, // identification, more fragments, offset 16
+		64, 6, 0, 0, // TTL, protocol TCP, checksum
+		10, 0, 0, 1,
+		10, 0, 0, 2,
+		1, 2, 3, 4,
+		0, 0, // Ethernet padding
+	}
+	ip, err := pcap.ParseIPV4Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, *ip.Fragment(), pcap.Fragment{ID: 0x1234, Offset: 16, MoreFragments: true})
+	assertEqual(t, ip.PayloadLength(), 4)
+}
+
+func TestParseIPV6Packet_FirstFragmentWithExtensionHeader(t *testing.T) {
+	raw := []byte{
+		0x60, 0, 0, 0,
+		0, 20, // payload length
+		44, // next header: fragment
+		64,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2,
+		// fragment, next header: destination options, offset 0, more fragments, id
+		60, 0, 0, 1, 0, 0, 0x12, 0x34,
+		// destination options, next header: TCP, padding only
+		6, 0, 1, 4, 0, 0, 0, 0,
+		// payload
+		1, 2, 3, 4,
+	}
+	ip, err := pcap.ParseIPV6Packet(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ip.Protocol(), uint8(6))
+	assertEqual(t, ip.HeaderLength(), uint16(56))
+	assertEqual(t, *ip.Fragment(), pcap.Fragment{ID: 0x1234, Offset: 0, MoreFragments: true, NextHeader: 60, ExtensionLength: 8})
+}
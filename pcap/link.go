@@ -0,0 +1,141 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// LinkType is the data link type of the capture, as in https://www.tcpdump.org/linktypes.html
+type LinkType uint16
+
+const (
+	LinkTypeNull       LinkType = 0   // BSD loopback, protocol family in host byte order
+	LinkTypeEthernet   LinkType = 1   // IEEE 802.3 Ethernet
+	LinkTypeRawBSD     LinkType = 12  // DLT_RAW as written by some BSDs
+	LinkTypeRawOpenBSD LinkType = 14  // DLT_RAW as written by OpenBSD
+	LinkTypeRaw        LinkType = 101 // raw IPv4 or IPv6
+	LinkTypeLoop       LinkType = 108 // OpenBSD loopback, protocol family in network byte order
+	LinkTypeLinuxSLL   LinkType = 113 // Linux "cooked" capture, v1
+	LinkTypeIPv4       LinkType = 228 // raw IPv4
+	LinkTypeIPv6       LinkType = 229 // raw IPv6
+	LinkTypeLinuxSLL2  LinkType = 276 // Linux "cooked" capture, v2
+
+	linuxSLLHdrSize  = 16
+	linuxSLL2HdrSize = 20
+	nullHdrSize      = 4
+)
+
+// Protocol families used in loopback headers. AF_INET6 differs between the systems.
+var (
+	nullFamilyIPv4 = []uint32{2}
+	nullFamilyIPv6 = []uint32{10, 24, 28, 30}
+)
+
+// Link is a link layer frame, with the type of the payload normalized to EtherType.
+// Ether is set only for Ethernet frames.
+type Link struct {
+	Type     LinkType
+	Ether    *Ether
+	Protocol uint16
+	Data     []byte
+}
+
+func (l *Link) String() string {
+	if l.Ether != nil {
+		return l.Ether.String()
+	}
+	return fmt.Sprintf("Link {type: %d, protocol: %#x}", l.Type, l.Protocol)
+}
+
+// ParseLinkLayer decodes link layer header according to the link type of the capture.
+func ParseLinkLayer(linkType LinkType, raw []byte) (*Link, error) {
+	switch linkType {
+	case LinkTypeEthernet:
+		eth, err := ParseEtherPacket(raw)
+		if err != nil {
+			return nil, err
+		}
+		return &Link{Type: linkType, Ether: eth, Protocol: eth.EtherType(), Data: eth.Data}, nil
+	case LinkTypeNull:
+		return parseNull(linkType, raw, nil)
+	case LinkTypeLoop:
+		return parseNull(linkType, raw, binary.BigEndian)
+	case LinkTypeRaw, LinkTypeRawBSD, LinkTypeRawOpenBSD, LinkTypeIPv4, LinkTypeIPv6:
+		return parseRaw(linkType, raw)
+	case LinkTypeLinuxSLL:
+		return parseLinuxSLL(linkType, raw)
+	case LinkTypeLinuxSLL2:
+		return parseLinuxSLL2(linkType, raw)
+	}
+	return nil, fmt.Errorf("Unsupported link type %d", linkType)
+}
+
+// parseNull decodes loopback header. If byteOrder is nil, the header is in the byte order of the
+// capturing host, which is guessed from the value.
+func parseNull(linkType LinkType, raw []byte, byteOrder binary.ByteOrder) (*Link, error) {
+	if len(raw) < nullHdrSize {
+		return nil, fmt.Errorf("Loopback frame too short: %d", len(raw))
+	}
+	if byteOrder == nil {
+		byteOrder = binary.LittleEndian
+		// Protocol family is a small number, so if it does not fit in lower bytes, it's the other order.
+		if byteOrder.Uint32(raw) > 0xFFFF {
+			byteOrder = binary.BigEndian
+		}
+	}
+	family := byteOrder.Uint32(raw)
+	if containsUint32(nullFamilyIPv4, family) {
+		return &Link{Type: linkType, Protocol: EtherTypeIPv4, Data: raw[nullHdrSize:]}, nil
+	}
+	if containsUint32(nullFamilyIPv6, family) {
+		return &Link{Type: linkType, Protocol: EtherTypeIPv6, Data: raw[nullHdrSize:]}, nil
+	}
+	return nil, fmt.Errorf("Unsupported loopback protocol family %d", family)
+}
+
+// parseRaw handles captures without link layer header, where the protocol is taken from the IP version.
+func parseRaw(linkType LinkType, raw []byte) (*Link, error) {
+	if len(raw) < 1 {
+		return nil, fmt.Errorf("Empty raw IP frame")
+	}
+	switch raw[0] >> 4 {
+	case 4:
+		return &Link{Type: linkType, Protocol: EtherTypeIPv4, Data: raw}, nil
+	case 6:
+		return &Link{Type: linkType, Protocol: EtherTypeIPv6, Data: raw}, nil
+	}
+	return nil, fmt.Errorf("Unknown IP version %d in raw frame", raw[0]>>4)
+}
+
+// https://www.tcpdump.org/linktypes/LINKTYPE_LINUX_SLL.html
+func parseLinuxSLL(linkType LinkType, raw []byte) (*Link, error) {
+	if len(raw) < linuxSLLHdrSize {
+		return nil, fmt.Errorf("Linux SLL frame too short: %d", len(raw))
+	}
+	return &Link{
+		Type:     linkType,
+		Protocol: binary.BigEndian.Uint16(raw[14:16]),
+		Data:     raw[linuxSLLHdrSize:],
+	}, nil
+}
+
+// https://www.tcpdump.org/linktypes/LINKTYPE_LINUX_SLL2.html
+func parseLinuxSLL2(linkType LinkType, raw []byte) (*Link, error) {
+	if len(raw) < linuxSLL2HdrSize {
+		return nil, fmt.Errorf("Linux SLL2 frame too short: %d", len(raw))
+	}
+	return &Link{
+		Type:     linkType,
+		Protocol: binary.BigEndian.Uint16(raw[0:2]),
+		Data:     raw[linuxSLL2HdrSize:],
+	}, nil
+}
+
+func containsUint32(values []uint32, v uint32) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
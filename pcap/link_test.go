@@ -0,0 +1,79 @@
+package pcap_test
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+func TestParseLinkLayer_LinuxSLL(t *testing.T) {
+	raw := []byte{0, 4, 0, 1, 0, 6, 1, 2, 3, 4, 5, 6, 0, 0, 0x08, 0x00, 0x45}
+	link, err := pcap.ParseLinkLayer(pcap.LinkTypeLinuxSLL, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, link.Protocol, uint16(pcap.EtherTypeIPv4))
+	assertEqual(t, len(link.Data), 1)
+}
+
+func TestParseLinkLayer_LinuxSLL2(t *testing.T) {
+	raw := []byte{0x86, 0xDD, 0, 0, 0, 0, 0, 2, 0, 1, 4, 6, 1, 2, 3, 4, 5, 6, 0, 0, 0x60}
+	link, err := pcap.ParseLinkLayer(pcap.LinkTypeLinuxSLL2, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, link.Protocol, uint16(pcap.EtherTypeIPv6))
+	assertEqual(t, len(link.Data), 1)
+}
+
+func TestParseLinkLayer_NullBothByteOrders(t *testing.T) {
+	for _, raw := range [][]byte{{2, 0, 0, 0, 0x45}, {0, 0, 0, 2, 0x45}} {
+		link, err := pcap.ParseLinkLayer(pcap.LinkTypeNull, raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, link.Protocol, uint16(pcap.EtherTypeIPv4))
+		assertEqual(t, len(link.Data), 1)
+	}
+}
+
+func TestParseLinkLayer_Raw(t *testing.T) {
+	link, err := pcap.ParseLinkLayer(pcap.LinkTypeRaw, []byte{0x60, 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, link.Protocol, uint16(pcap.EtherTypeIPv6))
+	assertEqual(t, len(link.Data), 2)
+}
+
+func TestParseLinkLayer_Unsupported(t *testing.T) {
+	_, err := pcap.ParseLinkLayer(pcap.LinkType(9999), []byte{0x45})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseEtherPacket_QinQ(t *testing.T) {
+	raw := []byte{
+		1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5, 6, 0x88, 0xA8,
+		0x00, 0x64, 0x81, 0x00, // outer tag, VLAN 100
+		0x20, 0x14, 0x08, 0x00, // inner tag, priority 1, VLAN 20
+		0x45,
+	}
+	eth, err := pcap.ParseEtherPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, eth.EtherType(), uint16(pcap.EtherTypeIPv4))
+	assertEqual(t, len(eth.VLANs()), 2)
+	assertEqual(t, eth.VLANs()[0], uint16(100))
+	assertEqual(t, eth.VLANs()[1], uint16(20))
+	assertEqual(t, len(eth.Data), 1)
+}
+
+func TestParseEtherPacket_TruncatedVLAN(t *testing.T) {
+	raw := []byte{1, 2, 3, 4, 5, 6, 1, 2, 3, 4, 5, 6, 0x81, 0x00, 0x00}
+	_, err := pcap.ParseEtherPacket(raw)
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -8,7 +8,14 @@ import (
 )
 
 const (
-	etherTypeIPv4 = 0x0800
+	EtherTypeIPv4 = 0x0800
+	EtherTypeIPv6 = 0x86DD
+
+	etherTypeVLAN    = 0x8100 // 802.1Q
+	etherTypeQinQ    = 0x88A8 // 802.1ad
+	etherTypeQinQOld = 0x9100 // pre-standard QinQ
+	vlanTagSize      = 4
+	vlanIDMask       = 0x0FFF
 )
 
 var etherHdrSize int
@@ -20,13 +27,27 @@ type etherHdr struct {
 	EtherType uint16
 }
 
+// etherType is the type of the payload, after all the VLAN tags.
+// vlans are VLAN IDs, from the outermost tag.
 type Ether struct {
-	hdr  *etherHdr
-	Data []byte
+	hdr       *etherHdr
+	etherType uint16
+	vlans     []uint16
+	Data      []byte
 }
 
 func (e *Ether) String() string {
-	return fmt.Sprintf("Ether {dst: %#x, src: %#x, etherType: %#x}", e.hdr.MacDest, e.hdr.MacSrc, e.hdr.EtherType)
+	return fmt.Sprintf("Ether {dst: %#x, src: %#x, etherType: %#x, vlans: %v}", e.hdr.MacDest, e.hdr.MacSrc, e.etherType, e.vlans)
+}
+
+// EtherType returns type of the payload.
+func (e *Ether) EtherType() uint16 {
+	return e.etherType
+}
+
+// VLANs returns VLAN IDs of the frame, from the outermost tag. It's empty for untagged frames.
+func (e *Ether) VLANs() []uint16 {
+	return e.vlans
 }
 
 func init() {
@@ -45,12 +66,27 @@ func ParseEtherPacket(raw []byte) (*Ether, error) {
 	}
 	nRead += etherHdrSize
 
-	if header.EtherType != etherTypeIPv4 {
-		return nil, fmt.Errorf("Expected IPv4 ethertype, got %#x", header.EtherType)
+	// Peel VLAN tags. Each tag is TCI followed by EtherType of what follows.
+	etherType := header.EtherType
+	vlans := []uint16{}
+	for isVLANTag(etherType) {
+		if len(raw) < nRead+vlanTagSize {
+			return nil, fmt.Errorf("Truncated VLAN tag")
+		}
+		tci := binary.BigEndian.Uint16(raw[nRead:])
+		etherType = binary.BigEndian.Uint16(raw[nRead+2:])
+		vlans = append(vlans, tci&vlanIDMask)
+		nRead += vlanTagSize
 	}
 
 	return &Ether{
-		hdr:  header,
-		Data: raw[nRead:],
+		hdr:       header,
+		etherType: etherType,
+		vlans:     vlans,
+		Data:      raw[nRead:],
 	}, nil
 }
+
+func isVLANTag(etherType uint16) bool {
+	return etherType == etherTypeVLAN || etherType == etherTypeQinQ || etherType == etherTypeQinQOld
+}
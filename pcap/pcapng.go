@@ -0,0 +1,287 @@
+package pcap
+
+// Support of the pcapng container format.
+// Taken from https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+const (
+	pcapngBlockTypeSHB = 0x0A0D0D0A // Section Header Block
+	pcapngBlockTypeIDB = 0x00000001 // Interface Description Block
+	pcapngBlockTypePB  = 0x00000002 // Packet Block (obsolete)
+	pcapngBlockTypeSPB = 0x00000003 // Simple Packet Block
+	pcapngBlockTypeEPB = 0x00000006 // Enhanced Packet Block
+
+	pcapngByteOrderMagic = 0x1A2B3C4D
+
+	pcapngOptEndOfOpt = 0
+	pcapngOptTSResol  = 9
+	pcapngOptTSOffset = 14
+
+	pcapngDefaultTSResol = 6 // microseconds
+	// pcapngMaxBlockSize protects from allocating huge buffers for corrupted block lengths.
+	pcapngMaxBlockSize = 128 * 1024 * 1024
+)
+
+type pcapng struct {
+	reader     io.Reader
+	byteOrder  binary.ByteOrder
+	interfaces []*pcapngInterface
+	// lastTimestamp is used for Simple Packet Blocks, which do not carry a timestamp.
+	lastTimestamp uint64
+}
+
+// pcapngInterface holds the details from Interface Description Block.
+// tsResol is the raw if_tsresol value: if the most significant bit is 0, the resolution is 10^-tsResol,
+// otherwise 2^-(tsResol&0x7F).
+// tsOffset is if_tsoffset in seconds.
+type pcapngInterface struct {
+	linkType uint16
+	snaplen  uint32
+	tsResol  uint8
+	tsOffset int64
+}
+
+func (p *pcapng) String() string {
+	return fmt.Sprintf("pcapng, interfaces: %d", len(p.interfaces))
+}
+
+// NewPcapng creates a reader of pcapng file. The file must begin with Section Header Block.
+func NewPcapng(r io.Reader) (*pcapng, error) {
+	p := &pcapng{reader: r}
+	blockType, _, err := p.readBlock()
+	if err != nil {
+		return nil, err
+	}
+	if blockType != pcapngBlockTypeSHB {
+		return nil, fmt.Errorf("Expected pcapng to start with section header block, got block type %#x", blockType)
+	}
+	return p, nil
+}
+
+func (p *pcapng) NextRecord() (*PcapRecord, error) {
+	for {
+		blockType, body, err := p.readBlock()
+		if err != nil {
+			return nil, err
+		}
+		switch blockType {
+		case pcapngBlockTypeIDB:
+			err = p.parseInterface(body)
+		case pcapngBlockTypeEPB:
+			return p.parseEnhancedPacket(body)
+		case pcapngBlockTypeSPB:
+			return p.parseSimplePacket(body)
+		case pcapngBlockTypePB:
+			return p.parsePacket(body)
+		}
+		// Section headers are handled in readBlock, other block types are skipped.
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readBlock reads a whole block and returns its body (without type and length fields). Section Header
+// Block is handled here since it determines byte order of the section.
+func (p *pcapng) readBlock() (blockType uint32, body []byte, err error) {
+	head := make([]byte, 8)
+	_, err = io.ReadFull(p.reader, head)
+	if err != nil {
+		return 0, nil, err
+	}
+	// Section Header Block type is a palindrome, so it reads the same in both byte orders.
+	if binary.LittleEndian.Uint32(head[:4]) == pcapngBlockTypeSHB {
+		bom := make([]byte, 4)
+		_, err = io.ReadFull(p.reader, bom)
+		if err != nil {
+			return 0, nil, noEOF(err)
+		}
+		if binary.LittleEndian.Uint32(bom) == pcapngByteOrderMagic {
+			p.byteOrder = binary.LittleEndian
+		} else if binary.BigEndian.Uint32(bom) == pcapngByteOrderMagic {
+			p.byteOrder = binary.BigEndian
+		} else {
+			return 0, nil, fmt.Errorf("Bad pcapng byte-order magic %#x", bom)
+		}
+		// Interface ids are local to the section.
+		p.interfaces = nil
+		head = append(head, bom...)
+	}
+	if p.byteOrder == nil {
+		return 0, nil, fmt.Errorf("pcapng block %#x before section header block", head[:4])
+	}
+
+	blockType = p.byteOrder.Uint32(head[:4])
+	totalLength := p.byteOrder.Uint32(head[4:8])
+	if totalLength < uint32(len(head))+4 || totalLength%4 != 0 || totalLength > pcapngMaxBlockSize {
+		return 0, nil, fmt.Errorf("Bad pcapng block length %d for block type %#x", totalLength, blockType)
+	}
+
+	rest := make([]byte, totalLength-uint32(len(head)))
+	_, err = io.ReadFull(p.reader, rest)
+	if err != nil {
+		return 0, nil, noEOF(err)
+	}
+	trailingLength := p.byteOrder.Uint32(rest[len(rest)-4:])
+	if trailingLength != totalLength {
+		return 0, nil, fmt.Errorf("Mismatched pcapng block lengths %d and %d for block type %#x", totalLength, trailingLength, blockType)
+	}
+	body = append(head[8:], rest[:len(rest)-4]...)
+	return blockType, body, nil
+}
+
+func (p *pcapng) parseInterface(body []byte) error {
+	if len(body) < 8 {
+		return fmt.Errorf("Interface description block too short: %d", len(body))
+	}
+	iface := &pcapngInterface{
+		linkType: p.byteOrder.Uint16(body[0:2]),
+		snaplen:  p.byteOrder.Uint32(body[4:8]),
+		tsResol:  pcapngDefaultTSResol,
+	}
+	options := p.parseOptions(body[8:])
+	if v, ok := options[pcapngOptTSResol]; ok && len(v) >= 1 {
+		iface.tsResol = v[0]
+	}
+	if v, ok := options[pcapngOptTSOffset]; ok && len(v) >= 8 {
+		iface.tsOffset = int64(p.byteOrder.Uint64(v))
+	}
+	if iface.tsResol&0x80 != 0 && iface.tsResol&0x7F > 63 {
+		return fmt.Errorf("Unsupported timestamp resolution %#x", iface.tsResol)
+	}
+	if iface.tsResol&0x80 == 0 && iface.tsResol > maxDecimalTSResol {
+		return fmt.Errorf("Unsupported timestamp resolution %#x", iface.tsResol)
+	}
+	p.interfaces = append(p.interfaces, iface)
+	return nil
+}
+
+// parseOptions returns the first value of each option. Malformed trailing options are ignored.
+func (p *pcapng) parseOptions(raw []byte) map[uint16][]byte {
+	options := make(map[uint16][]byte)
+	for len(raw) >= 4 {
+		code := p.byteOrder.Uint16(raw[0:2])
+		length := int(p.byteOrder.Uint16(raw[2:4]))
+		if code == pcapngOptEndOfOpt || 4+length > len(raw) {
+			break
+		}
+		if _, ok := options[code]; !ok {
+			options[code] = raw[4 : 4+length]
+		}
+		padded := (length + 3) &^ 3
+		if 4+padded > len(raw) {
+			break
+		}
+		raw = raw[4+padded:]
+	}
+	return options
+}
+
+func (p *pcapng) parseEnhancedPacket(body []byte) (*PcapRecord, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("Enhanced packet block too short: %d", len(body))
+	}
+	ifaceID := p.byteOrder.Uint32(body[0:4])
+	ts := uint64(p.byteOrder.Uint32(body[4:8]))<<32 | uint64(p.byteOrder.Uint32(body[8:12]))
+	capturedLen := p.byteOrder.Uint32(body[12:16])
+	origLen := p.byteOrder.Uint32(body[16:20])
+	return p.newRecord(ifaceID, ts, body[20:], capturedLen, origLen)
+}
+
+// parsePacket parses the obsolete Packet Block, which is still written by some old tools.
+func (p *pcapng) parsePacket(body []byte) (*PcapRecord, error) {
+	if len(body) < 20 {
+		return nil, fmt.Errorf("Packet block too short: %d", len(body))
+	}
+	ifaceID := uint32(p.byteOrder.Uint16(body[0:2]))
+	ts := uint64(p.byteOrder.Uint32(body[4:8]))<<32 | uint64(p.byteOrder.Uint32(body[8:12]))
+	capturedLen := p.byteOrder.Uint32(body[12:16])
+	origLen := p.byteOrder.Uint32(body[16:20])
+	return p.newRecord(ifaceID, ts, body[20:], capturedLen, origLen)
+}
+
+// parseSimplePacket parses Simple Packet Block. The block has no timestamp, so the timestamp of the
+// previous record is used.
+func (p *pcapng) parseSimplePacket(body []byte) (*PcapRecord, error) {
+	if len(body) < 4 {
+		return nil, fmt.Errorf("Simple packet block too short: %d", len(body))
+	}
+	if len(p.interfaces) == 0 {
+		return nil, fmt.Errorf("Simple packet block without interface description")
+	}
+	origLen := p.byteOrder.Uint32(body[0:4])
+	capturedLen := origLen
+	if snaplen := p.interfaces[0].snaplen; snaplen > 0 && capturedLen > snaplen {
+		capturedLen = snaplen
+	}
+	if int(capturedLen) > len(body)-4 {
+		capturedLen = uint32(len(body) - 4)
+	}
+	return &PcapRecord{
+		timestamp: p.lastTimestamp,
+		origLen:   origLen,
+		linkType:  LinkType(p.interfaces[0].linkType),
+		Data:      body[4 : 4+capturedLen],
+	}, nil
+}
+
+func (p *pcapng) newRecord(ifaceID uint32, ts uint64, data []byte, capturedLen, origLen uint32) (*PcapRecord, error) {
+	if int(ifaceID) >= len(p.interfaces) {
+		return nil, fmt.Errorf("Packet refers to unknown interface %d", ifaceID)
+	}
+	if int(capturedLen) > len(data) {
+		return nil, fmt.Errorf("Captured length %d exceeds block size %d", capturedLen, len(data))
+	}
+	p.lastTimestamp = p.interfaces[ifaceID].timestamp(ts)
+	return &PcapRecord{
+		timestamp: p.lastTimestamp,
+		origLen:   origLen,
+		linkType:  LinkType(p.interfaces[ifaceID].linkType),
+		Data:      data[:capturedLen],
+	}, nil
+}
+
+// timestamp converts timestamp in interface units to nanoseconds.
+func (i *pcapngInterface) timestamp(ts uint64) uint64 {
+	var ns uint64
+	if i.tsResol&0x80 == 0 {
+		exp := int(i.tsResol)
+		if exp <= 9 {
+			ns = ts * pow10(9-exp)
+		} else {
+			ns = ts / pow10(exp-9)
+		}
+	} else {
+		exp := uint(i.tsResol & 0x7F)
+		frac := ts & (1<<exp - 1)
+		hi, lo := bits.Mul64(frac, 1000000000)
+		fracNs, _ := bits.Div64(hi, lo, 1<<exp)
+		ns = (ts>>exp)*1000000000 + fracNs
+	}
+	return uint64(int64(ns) + i.tsOffset*1000000000)
+}
+
+// maxDecimalTSResol is the finest decimal resolution whose divisor (10^(tsResol-9)) fits in uint64.
+const maxDecimalTSResol = 9 + 19
+
+func pow10(n int) uint64 {
+	r := uint64(1)
+	for ; n > 0; n-- {
+		r *= 10
+	}
+	return r
+}
+
+// noEOF converts io.EOF to io.ErrUnexpectedEOF, for the cases where the file ends in the middle of a block.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,165 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+func TestPcapng_EnhancedPacketsPerInterfaceResolution(t *testing.T) {
+	order := binary.LittleEndian
+	buf := &bytes.Buffer{}
+	writeBlock(buf, order, 0x0A0D0D0A, sectionHeaderBody(order))
+	// Interface 0 with default microsecond resolution.
+	writeBlock(buf, order, 1, interfaceBody(order, nil))
+	// Interface 1 with nanosecond resolution and 10 seconds offset.
+	options := &bytes.Buffer{}
+	writeOption(options, order, 9, []byte{9})
+	offset := make([]byte, 8)
+	order.PutUint64(offset, 10)
+	writeOption(options, order, 14, offset)
+	writeBlock(buf, order, 1, interfaceBody(order, options.Bytes()))
+	// Unknown block, should be skipped.
+	writeBlock(buf, order, 0x0BAD, []byte{1, 2, 3, 4})
+	writeBlock(buf, order, 6, enhancedPacketBody(order, 0, 1500, []byte{1, 2, 3}))
+	writeBlock(buf, order, 6, enhancedPacketBody(order, 1, 1500, []byte{1, 2, 3, 4, 5}))
+
+	r, err := pcap.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := r.NextRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, record.Timestamp(), uint64(1500*1000))
+	assertEqual(t, len(record.Data), 3)
+
+	record, err = r.NextRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, record.Timestamp(), uint64(10*1000000000+1500))
+	assertEqual(t, len(record.Data), 5)
+
+	_, err = r.NextRecord()
+	assertEqual(t, err, io.EOF)
+}
+
+func TestPcapng_BigEndianBinaryResolution(t *testing.T) {
+	order := binary.BigEndian
+	buf := &bytes.Buffer{}
+	writeBlock(buf, order, 0x0A0D0D0A, sectionHeaderBody(order))
+	options := &bytes.Buffer{}
+	// 2^-10 of a second.
+	writeOption(options, order, 9, []byte{0x80 | 10})
+	writeBlock(buf, order, 1, interfaceBody(order, options.Bytes()))
+	writeBlock(buf, order, 6, enhancedPacketBody(order, 0, 1024+512, []byte{1}))
+
+	r, err := pcap.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := r.NextRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, record.Timestamp(), uint64(1500000000))
+}
+
+func TestPcapng_UnknownInterface(t *testing.T) {
+	order := binary.LittleEndian
+	buf := &bytes.Buffer{}
+	writeBlock(buf, order, 0x0A0D0D0A, sectionHeaderBody(order))
+	writeBlock(buf, order, 6, enhancedPacketBody(order, 0, 1, []byte{1}))
+
+	r, err := pcap.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = r.NextRecord()
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestPcapng_DecimalResolutionOverflow(t *testing.T) {
+	for _, tsResol := range []uint8{29, 73} {
+		order := binary.LittleEndian
+		buf := &bytes.Buffer{}
+		writeBlock(buf, order, 0x0A0D0D0A, sectionHeaderBody(order))
+		options := &bytes.Buffer{}
+		writeOption(options, order, 9, []byte{tsResol})
+		writeBlock(buf, order, 1, interfaceBody(order, options.Bytes()))
+		writeBlock(buf, order, 6, enhancedPacketBody(order, 0, 1500, []byte{1}))
+
+		r, err := pcap.NewReader(buf)
+		if err != nil {
+			continue
+		}
+		_, err = r.NextRecord()
+		if err == nil {
+			t.Errorf("Expected error for resolution %d", tsResol)
+		}
+	}
+}
+
+func TestPcapng_FinestDecimalResolution(t *testing.T) {
+	order := binary.LittleEndian
+	buf := &bytes.Buffer{}
+	writeBlock(buf, order, 0x0A0D0D0A, sectionHeaderBody(order))
+	options := &bytes.Buffer{}
+	// 10^-28 of a second.
+	writeOption(options, order, 9, []byte{28})
+	writeBlock(buf, order, 1, interfaceBody(order, options.Bytes()))
+	writeBlock(buf, order, 6, enhancedPacketBody(order, 0, 10000000000000000000, []byte{1}))
+
+	r, err := pcap.NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := r.NextRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, record.Timestamp(), uint64(1))
+}
+
+func writeBlock(buf *bytes.Buffer, order binary.ByteOrder, blockType uint32, body []byte) {
+	length := uint32(12 + len(body))
+	binary.Write(buf, order, []uint32{blockType, length})
+	buf.Write(body)
+	binary.Write(buf, order, length)
+}
+
+func writeOption(buf *bytes.Buffer, order binary.ByteOrder, code uint16, value []byte) {
+	binary.Write(buf, order, []uint16{code, uint16(len(value))})
+	buf.Write(value)
+	buf.Write(make([]byte, (4-len(value)%4)%4))
+}
+
+func sectionHeaderBody(order binary.ByteOrder) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, order, uint32(0x1A2B3C4D))
+	binary.Write(buf, order, []uint16{1, 0})
+	binary.Write(buf, order, int64(-1))
+	return buf.Bytes()
+}
+
+func interfaceBody(order binary.ByteOrder, options []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, order, []uint16{1, 0})
+	binary.Write(buf, order, uint32(65535))
+	buf.Write(options)
+	return buf.Bytes()
+}
+
+func enhancedPacketBody(order binary.ByteOrder, ifaceID uint32, ts uint64, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, order, []uint32{ifaceID, uint32(ts >> 32), uint32(ts), uint32(len(data)), uint32(len(data))})
+	buf.Write(data)
+	buf.Write(make([]byte, (4-len(data)%4)%4))
+	return buf.Bytes()
+}
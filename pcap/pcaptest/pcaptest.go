@@ -0,0 +1,94 @@
+// Package pcaptest builds captures for tests: classic pcap files of Ethernet frames with IPv4, TCP and ICMP.
+// Checksums are not filled in.
+package pcaptest
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Magic numbers of classic pcap files, with microsecond and nanosecond timestamps.
+const (
+	MagicMicro = 0xA1B2C3D4
+	MagicNano  = 0xA1B23C4D
+)
+
+// Record is a record of a test capture. Sec and Frac are the timestamp, Frac in the resolution of the file. Data
+// is the whole frame on the wire, CapLen is how many bytes of it were captured, zero for all.
+type Record struct {
+	Sec    uint32
+	Frac   uint32
+	Data   []byte
+	CapLen int
+}
+
+// RecordAtUsec is a record of the whole frame, at the given time in microseconds.
+func RecordAtUsec(usec uint32, data []byte) Record {
+	return Record{Sec: usec / 1000000, Frac: usec % 1000000, Data: data}
+}
+
+// Write writes the records as a classic pcap file of Ethernet link type.
+func Write(order binary.ByteOrder, magic uint32, records ...Record) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, order, []uint32{magic})
+	binary.Write(buf, order, []uint16{2, 4})
+	binary.Write(buf, order, []uint32{0, 0, 262144, 1})
+	for _, r := range records {
+		data := r.Data
+		if r.CapLen > 0 {
+			data = data[:r.CapLen]
+		}
+		binary.Write(buf, order, []uint32{r.Sec, r.Frac, uint32(len(data)), uint32(len(r.Data))})
+		buf.Write(data)
+	}
+	return buf
+}
+
+// Ethernet wraps the IPv4 packet in an Ethernet frame.
+func Ethernet(ip []byte) []byte {
+	frame := []byte{1, 2, 3, 4, 5, 6, 6, 5, 4, 3, 2, 1, 0x08, 0x00}
+	return append(frame, ip...)
+}
+
+// EthernetVLAN wraps the IPv4 packet in an Ethernet frame with an 802.1Q tag.
+func EthernetVLAN(vlan uint16, ip []byte) []byte {
+	frame := []byte{1, 2, 3, 4, 5, 6, 6, 5, 4, 3, 2, 1, 0x81, 0x00}
+	frame = binary.BigEndian.AppendUint16(frame, vlan)
+	frame = append(frame, 0x08, 0x00)
+	return append(frame, ip...)
+}
+
+// IPv4 builds an IPv4 packet. totalLength is written to the header as is, so it can be bogus. fragment is the
+// flags and the fragment offset field.
+func IPv4(totalLength, id, fragment uint16, protocol uint8, src, dst, payload []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, []uint8{0x45, 0})
+	binary.Write(buf, binary.BigEndian, []uint16{totalLength, id, fragment})
+	binary.Write(buf, binary.BigEndian, []uint8{64, protocol, 0, 0})
+	buf.Write(src)
+	buf.Write(dst)
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// TCP builds a TCP segment with window 65535 and payload of zeros. options are raw TCP options, padded to 4 bytes
+// by the caller.
+func TCP(srcPort, dstPort uint16, seq, ack uint32, flags uint16, options []byte, payload int) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, []uint16{srcPort, dstPort})
+	binary.Write(buf, binary.BigEndian, []uint32{seq, ack})
+	binary.Write(buf, binary.BigEndian, []uint16{uint16(5+len(options)/4)<<12 | flags, 65535, 0, 0})
+	buf.Write(options)
+	buf.Write(make([]byte, payload))
+	return buf.Bytes()
+}
+
+// ICMP builds an ICMP message. rest is the last 4 bytes of the header (e.g. MTU of "fragmentation needed"),
+// quoted is the packet the message is about.
+func ICMP(icmpType, code uint8, rest uint32, quoted []byte) []byte {
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.BigEndian, []uint8{icmpType, code, 0, 0})
+	binary.Write(buf, binary.BigEndian, rest)
+	buf.Write(quoted)
+	return buf.Bytes()
+}
@@ -3,18 +3,26 @@ package pcap
 // Rudimentary support of reading basic info from TCP packets.
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 )
 
 const (
-	magicNumber = 0xA1B2C3D4
+	magicNumber     = 0xA1B2C3D4 // microsecond resolution
+	magicNumberNano = 0xA1B23C4D // nanosecond resolution
+
+	pcapGlobalHdrSize = 24
 )
 
 type pcap struct {
-	hdr    *pcapGlobalHdr
-	reader io.Reader
+	hdr       *pcapGlobalHdr
+	reader    io.Reader
+	byteOrder binary.ByteOrder
+	nanoRes   bool
 }
 
 func (p *pcap) String() string {
@@ -34,47 +42,102 @@ type pcapGlobalHdr struct {
 
 type pcapRecordHdr struct {
 	TSSec   uint32 // timestamp seconds
-	TSUsec  uint32 // timestamp microseconds
+	TSUsec  uint32 // timestamp microseconds (or nanoseconds, depending on the magic number)
 	InclLen uint32 // number of octets of packet saved in file
 	OrigLen uint32 // actual length of packet
 }
 
+// PcapRecord is a single captured packet, regardless of the container format it was read from.
 type PcapRecord struct {
-	hdr  *pcapRecordHdr
-	Data []byte
+	timestamp uint64
+	origLen   uint32
+	linkType  LinkType
+	Data      []byte
 }
 
-// Timestamp return microseconds.
+// Timestamp returns nanoseconds.
 func (r *PcapRecord) Timestamp() uint64 {
-	return uint64(r.hdr.TSSec)*1000000 + uint64(r.hdr.TSUsec)
+	return r.timestamp
 }
 
 func (r *PcapRecord) OrigLen() uint32 {
-	return r.hdr.OrigLen
+	return r.origLen
+}
+
+// IsTruncated tells if the packet was cut by the snap length, i.e. fewer bytes were captured than were on the wire.
+func (r *PcapRecord) IsTruncated() bool {
+	return uint32(len(r.Data)) < r.origLen
+}
+
+// LinkType is the link layer type of the interface the record was captured on.
+func (r *PcapRecord) LinkType() LinkType {
+	return r.linkType
 }
 
 func (r *PcapRecord) String() string {
-	return fmt.Sprintf("%+v, data=%d", r.hdr, len(r.Data))
+	return fmt.Sprintf("{ts=%d, origLen=%d, link=%d}, data=%d", r.timestamp, r.origLen, r.linkType, len(r.Data))
+}
+
+// RecordReader is implemented by readers of all the supported capture file formats.
+type RecordReader interface {
+	NextRecord() (*PcapRecord, error)
+}
+
+// NewReader detects the container format (classic pcap or pcapng) and returns a reader for it.
+func NewReader(r io.Reader) (RecordReader, error) {
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(r, magic)
+	if err != nil {
+		return nil, err
+	}
+	// Put the magic number back, the format specific readers parse whole headers.
+	r = io.MultiReader(bytes.NewReader(magic), r)
+	if binary.LittleEndian.Uint32(magic) == pcapngBlockTypeSHB {
+		return NewPcapng(r)
+	}
+	return NewPcap(r)
 }
 
 func NewPcap(r io.Reader) (*pcap, error) {
-	hdr := &pcapGlobalHdr{}
-	err := binary.Read(r, binary.LittleEndian, hdr)
+	raw := make([]byte, pcapGlobalHdrSize)
+	_, err := io.ReadFull(r, raw)
 	if err != nil {
 		return nil, err
 	}
-	if hdr.MagicNumber != magicNumber {
-		return nil, fmt.Errorf("Expected magic number to be %#x and got %#x", magicNumber, hdr.MagicNumber)
+	byteOrder, nanoRes, err := detectMagicNumber(raw[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := &pcapGlobalHdr{}
+	err = binary.Read(bytes.NewReader(raw), byteOrder, hdr)
+	if err != nil {
+		return nil, err
 	}
 	return &pcap{
-		hdr:    hdr,
-		reader: r,
+		hdr:       hdr,
+		reader:    r,
+		byteOrder: byteOrder,
+		nanoRes:   nanoRes,
 	}, nil
 }
 
+// detectMagicNumber figures out byte order and timestamp resolution from the first four bytes of the file.
+func detectMagicNumber(magic []byte) (byteOrder binary.ByteOrder, nanoRes bool, err error) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(magic) {
+		case magicNumber:
+			return order, false, nil
+		case magicNumberNano:
+			return order, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("Expected magic number to be %#x or %#x and got %#x", magicNumber, magicNumberNano, magic)
+}
+
 func (p *pcap) NextRecord() (*PcapRecord, error) {
 	hdr := &pcapRecordHdr{}
-	err := binary.Read(p.reader, binary.LittleEndian, hdr)
+	err := binary.Read(p.reader, p.byteOrder, hdr)
 	if err != nil {
 		return nil, err
 	}
@@ -84,7 +147,63 @@ func (p *pcap) NextRecord() (*PcapRecord, error) {
 		return nil, err
 	}
 	return &PcapRecord{
-		hdr:  hdr,
-		Data: buf,
+		timestamp: p.timestamp(hdr),
+		origLen:   hdr.OrigLen,
+		linkType:  p.linkType(),
+		Data:      buf,
 	}, nil
 }
+
+// linkType returns link type of the file. The upper bits of the Network field are used for FCS
+// details and are not part of the link type.
+func (p *pcap) linkType() LinkType {
+	return LinkType(p.hdr.Network & 0xFFFF)
+}
+
+// timestamp converts record timestamp to nanoseconds.
+func (p *pcap) timestamp(hdr *pcapRecordHdr) uint64 {
+	if p.nanoRes {
+		return uint64(hdr.TSSec)*1000000000 + uint64(hdr.TSUsec)
+	}
+	return uint64(hdr.TSSec)*1000000000 + uint64(hdr.TSUsec)*1000
+}
+
+// FollowReader reads a file that is still being written, like "tail -f". At the end of the file it blocks
+// and polls for new data instead of returning io.EOF, so partially written records are read once the rest
+// of them is written. io.EOF is returned only after Stop is called.
+type FollowReader struct {
+	reader   io.Reader
+	interval time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func NewFollowReader(r io.Reader, interval time.Duration) *FollowReader {
+	return &FollowReader{
+		reader:   r,
+		interval: interval,
+		stop:     make(chan struct{}),
+	}
+}
+
+func (f *FollowReader) Read(p []byte) (int, error) {
+	for {
+		n, err := f.reader.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		select {
+		case <-f.stop:
+			return 0, io.EOF
+		case <-time.After(f.interval):
+		}
+	}
+}
+
+// Stop makes the reader return io.EOF at the end of the data written so far.
+func (f *FollowReader) Stop() {
+	f.stopOnce.Do(func() { close(f.stop) })
+}
@@ -0,0 +1,108 @@
+package pcap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"jakub-m/bdp/pcap"
+	"jakub-m/bdp/pcap/pcaptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewPcap_LittleEndianMicro(t *testing.T) {
+	r := buildPcap(binary.LittleEndian, pcaptest.MagicMicro, 10, 20)
+	assertRecordTimestamp(t, r, 10*1000000000+20*1000)
+}
+
+func TestNewPcap_BigEndianMicro(t *testing.T) {
+	r := buildPcap(binary.BigEndian, pcaptest.MagicMicro, 10, 20)
+	assertRecordTimestamp(t, r, 10*1000000000+20*1000)
+}
+
+func TestNewPcap_LittleEndianNano(t *testing.T) {
+	r := buildPcap(binary.LittleEndian, pcaptest.MagicNano, 10, 20)
+	assertRecordTimestamp(t, r, 10*1000000000+20)
+}
+
+func TestNewPcap_BigEndianNano(t *testing.T) {
+	r := buildPcap(binary.BigEndian, pcaptest.MagicNano, 10, 20)
+	assertRecordTimestamp(t, r, 10*1000000000+20)
+}
+
+func TestNewPcap_BadMagic(t *testing.T) {
+	r := buildPcap(binary.LittleEndian, 0x12345678, 10, 20)
+	_, err := pcap.NewPcap(r)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+// buildPcap creates a classic pcap file with a single 4-byte record.
+func buildPcap(order binary.ByteOrder, magic uint32, tsSec, tsFrac uint32) *bytes.Buffer {
+	return pcaptest.Write(order, magic, pcaptest.Record{Sec: tsSec, Frac: tsFrac, Data: []byte{1, 2, 3, 4}})
+}
+
+func assertRecordTimestamp(t *testing.T, r *bytes.Buffer, expected uint64) {
+	p, err := pcap.NewPcap(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := p.NextRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, record.Timestamp(), expected)
+	assertEqual(t, len(record.Data), 4)
+}
+
+func TestFollowReader_PartialRecord(t *testing.T) {
+	fname := t.TempDir() + "/follow.pcap"
+	content := buildPcap(binary.LittleEndian, pcaptest.MagicMicro, 10, 20).Bytes()
+	// Write the file header and a part of the record header.
+	err := os.WriteFile(fname, content[:30], 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.Open(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	follower := pcap.NewFollowReader(file, time.Millisecond)
+	p, err := pcap.NewPcap(follower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := make(chan *pcap.PcapRecord)
+	errs := make(chan error)
+	go func() {
+		record, err := p.NextRecord()
+		if err != nil {
+			errs <- err
+			return
+		}
+		records <- record
+	}()
+
+	// Write the rest of the record.
+	out, err := os.OpenFile(fname, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(content[30:])
+	out.Close()
+
+	select {
+	case record := <-records:
+		assertEqual(t, len(record.Data), 4)
+	case err := <-errs:
+		t.Fatal(err)
+	}
+
+	follower.Stop()
+	_, err = p.NextRecord()
+	assertEqual(t, err, io.EOF)
+}
@@ -18,38 +18,121 @@ type tcpHdr struct {
 	UrgentPointer uint16
 }
 
+const tcpHdrSize = 20
+
+// TCP flags, in the low bits of Offset_Flags.
+const (
+	tcpFlagFin = 0x0001
+	tcpFlagSyn = 0x0002
+	tcpFlagRst = 0x0004
+	tcpFlagPsh = 0x0008
+	tcpFlagAck = 0x0010
+	tcpFlagUrg = 0x0020
+	tcpFlagEce = 0x0040
+	tcpFlagCwr = 0x0080
+)
+
 type SeqNum uint32
 
+// RelativeTo returns the distance from r to s, wrapping around at 2^32.
 func (s SeqNum) RelativeTo(r SeqNum) SeqNum {
-	return SeqNum(uint32(s) - uint32(r))
+	return SeqNum(uint32(s.Diff(r)))
 }
 
+// ExpectedForPayload returns the sequence number following a payload of the given size.
 func (s SeqNum) ExpectedForPayload(size uint16) SeqNum {
-	return SeqNum(uint32(s) + uint32(size))
+	return s.Add(uint32(size))
 }
 
+// Diff returns the signed distance from o to s. Sequence numbers wrap around, so the distance is correct as long
+// as the numbers are less than 2^31 apart (serial number arithmetic, RFC 1982).
+func (s SeqNum) Diff(o SeqNum) int32 {
+	return int32(uint32(s) - uint32(o))
+}
+
+// Before tells if s precedes o, taking the wraparound into account.
+func (s SeqNum) Before(o SeqNum) bool {
+	return s.Diff(o) < 0
+}
+
+// After tells if s follows o, taking the wraparound into account.
+func (s SeqNum) After(o SeqNum) bool {
+	return s.Diff(o) > 0
+}
+
+// Add advances the sequence number by n, wrapping around at 2^32.
+func (s SeqNum) Add(n uint32) SeqNum {
+	return SeqNum(uint32(s) + n)
+}
+
+// options are never nil, optionsErr is set if the option list is malformed or truncated. raw is the segment as
+// captured, for the checksum verification.
 type TcpPacket struct {
-	hdr *tcpHdr
+	hdr        *tcpHdr
+	options    *TcpOptions
+	optionsErr error
+	raw        []byte
 }
 
 func (f *TcpPacket) String() string {
-	syn := ""
-	ack := ""
-	if f.IsSyn() {
-		syn = "syn "
-	}
-	if f.IsAck() {
-		ack = "ack "
+	return fmt.Sprintf("TCP %s%+v %s", f.flagsString(), f.hdr, f.options)
+}
+
+// flagsString lists the flags set, each followed by space.
+func (f *TcpPacket) flagsString() string {
+	flags := ""
+	for _, flag := range []struct {
+		isSet bool
+		name  string
+	}{
+		{f.IsSyn(), "syn"},
+		{f.IsFin(), "fin"},
+		{f.IsRst(), "rst"},
+		{f.IsPsh(), "psh"},
+		{f.IsAck(), "ack"},
+		{f.IsUrg(), "urg"},
+		{f.IsEce(), "ece"},
+		{f.IsCwr(), "cwr"},
+	} {
+		if flag.isSet {
+			flags += flag.name + " "
+		}
 	}
-	return fmt.Sprintf("TCP %s%s%+v", syn, ack, f.hdr)
+	return flags
 }
 
 func (f *TcpPacket) IsSyn() bool {
-	return f.hdr.Offset_Flags&0x0002 != 0
+	return f.hdr.Offset_Flags&tcpFlagSyn != 0
 }
 
 func (f *TcpPacket) IsAck() bool {
-	return f.hdr.Offset_Flags&0x0010 != 0
+	return f.hdr.Offset_Flags&tcpFlagAck != 0
+}
+
+func (f *TcpPacket) IsFin() bool {
+	return f.hdr.Offset_Flags&tcpFlagFin != 0
+}
+
+func (f *TcpPacket) IsRst() bool {
+	return f.hdr.Offset_Flags&tcpFlagRst != 0
+}
+
+func (f *TcpPacket) IsPsh() bool {
+	return f.hdr.Offset_Flags&tcpFlagPsh != 0
+}
+
+func (f *TcpPacket) IsUrg() bool {
+	return f.hdr.Offset_Flags&tcpFlagUrg != 0
+}
+
+// IsEce tells if ECN-Echo flag is set (RFC 3168).
+func (f *TcpPacket) IsEce() bool {
+	return f.hdr.Offset_Flags&tcpFlagEce != 0
+}
+
+// IsCwr tells if Congestion Window Reduced flag is set (RFC 3168).
+func (f *TcpPacket) IsCwr() bool {
+	return f.hdr.Offset_Flags&tcpFlagCwr != 0
 }
 
 func (f *TcpPacket) SeqNum() SeqNum {
@@ -77,6 +160,16 @@ func (f *TcpPacket) WindowSize() uint16 {
 	return f.hdr.WindowSize
 }
 
+// Options returns the options parsed so far, even if the option list is malformed.
+func (f *TcpPacket) Options() *TcpOptions {
+	return f.options
+}
+
+// OptionsError tells why the options could not be parsed completely, nil if they were fine.
+func (f *TcpPacket) OptionsError() error {
+	return f.optionsErr
+}
+
 func ParseTCPPacket(raw []byte) (*TcpPacket, error) {
 	reader := bytes.NewReader(raw)
 	header := &tcpHdr{}
@@ -85,7 +178,26 @@ func ParseTCPPacket(raw []byte) (*TcpPacket, error) {
 		return nil, err
 	}
 
+	options, optionsErr := parseOptionsOf(header, raw)
+
 	return &TcpPacket{
-		hdr: header,
+		hdr:        header,
+		options:    options,
+		optionsErr: optionsErr,
+		raw:        raw,
 	}, nil
 }
+
+// parseOptionsOf parses options between the fixed header and the data offset. Malformed options do not
+// make the whole segment invalid.
+func parseOptionsOf(header *tcpHdr, raw []byte) (*TcpOptions, error) {
+	headerSize := int((header.Offset_Flags & 0xF000 >> 12) * 4)
+	if headerSize < tcpHdrSize {
+		return &TcpOptions{}, fmt.Errorf("Bad TCP data offset %d", headerSize)
+	}
+	if headerSize > len(raw) {
+		options, _ := ParseTCPOptions(raw[tcpHdrSize:])
+		return options, fmt.Errorf("TCP options truncated, header size %d, got %d", headerSize, len(raw))
+	}
+	return ParseTCPOptions(raw[tcpHdrSize:headerSize])
+}
@@ -24,6 +24,49 @@ func TestSeqNum_Relative_SomeZero(t *testing.T) {
 	assertEqual(t, x.RelativeTo(r), pcap.SeqNum(math.MaxUint32))
 }
 
+func TestSeqNum_Before_Wraparound(t *testing.T) {
+	x := pcap.SeqNum(math.MaxUint32 - 10)
+	y := pcap.SeqNum(10)
+	assertEqual(t, x.Before(y), true)
+	assertEqual(t, y.After(x), true)
+	assertEqual(t, y.Before(x), false)
+	assertEqual(t, y.Diff(x), int32(21))
+	assertEqual(t, x.Diff(y), int32(-21))
+}
+
+func TestSeqNum_Before_Equal(t *testing.T) {
+	x := pcap.SeqNum(100)
+	assertEqual(t, x.Before(x), false)
+	assertEqual(t, x.After(x), false)
+}
+
+func TestSeqNum_Add_Wraparound(t *testing.T) {
+	x := pcap.SeqNum(math.MaxUint32 - 1)
+	assertEqual(t, x.Add(3), pcap.SeqNum(1))
+}
+
+func TestParseTCPPacket_Flags(t *testing.T) {
+	raw := []byte{
+		0, 80, 1, 187, // ports
+		0, 0, 0, 1, // seq
+		0, 0, 0, 0, // ack
+		0x50, 0xC5, 0xFF, 0xFF, // data offset 20 bytes, cwr ece rst fin, window
+		0, 0, 0, 0, // checksum, urgent pointer
+	}
+	tcp, err := pcap.ParseTCPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, tcp.IsFin(), true)
+	assertEqual(t, tcp.IsSyn(), false)
+	assertEqual(t, tcp.IsRst(), true)
+	assertEqual(t, tcp.IsPsh(), false)
+	assertEqual(t, tcp.IsAck(), false)
+	assertEqual(t, tcp.IsUrg(), false)
+	assertEqual(t, tcp.IsEce(), true)
+	assertEqual(t, tcp.IsCwr(), true)
+}
+
 func assertEqual(t *testing.T, actual interface{}, expected interface{}) {
 	if expected == actual {
 		return
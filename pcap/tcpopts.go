@@ -0,0 +1,131 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// https://www.iana.org/assignments/tcp-parameters/tcp-parameters.xhtml
+const (
+	tcpOptEnd           = 0
+	tcpOptNop           = 1
+	tcpOptMSS           = 2
+	tcpOptWindowScale   = 3
+	tcpOptSACKPermitted = 4
+	tcpOptSACK          = 5
+	tcpOptTimestamps    = 8
+
+	// maxWindowScale is the largest shift allowed by RFC 7323, larger values are treated as 14.
+	maxWindowScale = 14
+)
+
+// SACKBlock is a range of sequence numbers received out of order, Right is exclusive.
+type SACKBlock struct {
+	Left  SeqNum
+	Right SeqNum
+}
+
+// TcpOptions holds the TCP options of a segment. Has* fields tell if the respective option was present.
+type TcpOptions struct {
+	MSS            uint16
+	HasMSS         bool
+	WindowScale    uint8
+	HasWindowScale bool
+	SACKPermitted  bool
+	SACKBlocks     []SACKBlock
+	TSVal          uint32
+	TSEcr          uint32
+	HasTimestamps  bool
+}
+
+func (o *TcpOptions) String() string {
+	s := ""
+	if o.HasMSS {
+		s += fmt.Sprintf(" mss %d", o.MSS)
+	}
+	if o.HasWindowScale {
+		s += fmt.Sprintf(" wscale %d", o.WindowScale)
+	}
+	if o.SACKPermitted {
+		s += " sackOK"
+	}
+	for _, b := range o.SACKBlocks {
+		s += fmt.Sprintf(" sack %d-%d", b.Left, b.Right)
+	}
+	if o.HasTimestamps {
+		s += fmt.Sprintf(" ts %d ecr %d", o.TSVal, o.TSEcr)
+	}
+	return fmt.Sprintf("{%s }", s)
+}
+
+// ParseTCPOptions parses TCP options. If the option list is malformed, the options parsed so far are returned
+// together with the error. Unknown options are skipped.
+func ParseTCPOptions(raw []byte) (*TcpOptions, error) {
+	options := &TcpOptions{}
+	for i := 0; i < len(raw); {
+		kind := raw[i]
+		if kind == tcpOptEnd {
+			break
+		}
+		if kind == tcpOptNop {
+			i++
+			continue
+		}
+		if i+1 >= len(raw) {
+			return options, fmt.Errorf("Truncated TCP option %d", kind)
+		}
+		length := int(raw[i+1])
+		if length < 2 || i+length > len(raw) {
+			return options, fmt.Errorf("Bad length %d of TCP option %d", length, kind)
+		}
+		value := raw[i+2 : i+length]
+		if err := options.set(kind, value); err != nil {
+			return options, err
+		}
+		i += length
+	}
+	return options, nil
+}
+
+func (o *TcpOptions) set(kind uint8, value []byte) error {
+	switch kind {
+	case tcpOptMSS:
+		if len(value) != 2 {
+			return fmt.Errorf("Bad MSS option length %d", len(value))
+		}
+		o.MSS = binary.BigEndian.Uint16(value)
+		o.HasMSS = true
+	case tcpOptWindowScale:
+		if len(value) != 1 {
+			return fmt.Errorf("Bad window scale option length %d", len(value))
+		}
+		o.WindowScale = value[0]
+		if o.WindowScale > maxWindowScale {
+			o.WindowScale = maxWindowScale
+		}
+		o.HasWindowScale = true
+	case tcpOptSACKPermitted:
+		if len(value) != 0 {
+			return fmt.Errorf("Bad SACK-permitted option length %d", len(value))
+		}
+		o.SACKPermitted = true
+	case tcpOptSACK:
+		if len(value) == 0 || len(value)%8 != 0 {
+			return fmt.Errorf("Bad SACK option length %d", len(value))
+		}
+		for k := 0; k < len(value); k += 8 {
+			o.SACKBlocks = append(o.SACKBlocks, SACKBlock{
+				Left:  SeqNum(binary.BigEndian.Uint32(value[k:])),
+				Right: SeqNum(binary.BigEndian.Uint32(value[k+4:])),
+			})
+		}
+	case tcpOptTimestamps:
+		if len(value) != 8 {
+			return fmt.Errorf("Bad timestamps option length %d", len(value))
+		}
+		o.TSVal = binary.BigEndian.Uint32(value)
+		o.TSEcr = binary.BigEndian.Uint32(value[4:])
+		o.HasTimestamps = true
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package pcap_test
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+func TestParseTCPOptions_Syn(t *testing.T) {
+	raw := []byte{
+		2, 4, 0x05, 0xB4, // mss 1460
+		4, 2, // sack permitted
+		8, 10, 0, 0, 0, 1, 0, 0, 0, 0, // timestamps
+		1,       // nop
+		3, 3, 7, // wscale 7
+	}
+	o, err := pcap.ParseTCPOptions(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, o.HasMSS, true)
+	assertEqual(t, o.MSS, uint16(1460))
+	assertEqual(t, o.SACKPermitted, true)
+	assertEqual(t, o.HasTimestamps, true)
+	assertEqual(t, o.TSVal, uint32(1))
+	assertEqual(t, o.TSEcr, uint32(0))
+	assertEqual(t, o.HasWindowScale, true)
+	assertEqual(t, o.WindowScale, uint8(7))
+}
+
+func TestParseTCPOptions_SACKBlocks(t *testing.T) {
+	raw := []byte{1, 1, 5, 18, 0, 0, 0, 10, 0, 0, 0, 20, 0, 0, 0, 30, 0, 0, 0, 40}
+	o, err := pcap.ParseTCPOptions(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(o.SACKBlocks), 2)
+	assertEqual(t, o.SACKBlocks[0], pcap.SACKBlock{Left: 10, Right: 20})
+	assertEqual(t, o.SACKBlocks[1], pcap.SACKBlock{Left: 30, Right: 40})
+}
+
+func TestParseTCPOptions_WindowScaleClamped(t *testing.T) {
+	o, err := pcap.ParseTCPOptions([]byte{3, 3, 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, o.WindowScale, uint8(14))
+}
+
+func TestParseTCPOptions_EndOfList(t *testing.T) {
+	o, err := pcap.ParseTCPOptions([]byte{0, 2, 4, 0x05, 0xB4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, o.HasMSS, false)
+}
+
+func TestParseTCPOptions_MalformedKeepsParsed(t *testing.T) {
+	raw := []byte{2, 4, 0x05, 0xB4, 8, 30, 0, 0}
+	o, err := pcap.ParseTCPOptions(raw)
+	if err == nil {
+		t.Fail()
+	}
+	assertEqual(t, o.MSS, uint16(1460))
+	assertEqual(t, o.HasTimestamps, false)
+}
+
+func TestParseTCPOptions_ZeroLength(t *testing.T) {
+	_, err := pcap.ParseTCPOptions([]byte{2, 0, 0, 0})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestParseTCPPacket_Options(t *testing.T) {
+	raw := []byte{
+		0, 80, 1, 187, // ports
+		0, 0, 0, 1, // seq
+		0, 0, 0, 0, // ack
+		0x60, 0x02, 0xFF, 0xFF, // data offset 24 bytes, syn, window
+		0, 0, 0, 0, // checksum, urgent pointer
+		2, 4, 0x05, 0xB4,
+	}
+	tcp, err := pcap.ParseTCPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, tcp.OptionsError(), nil)
+	assertEqual(t, tcp.Options().MSS, uint16(1460))
+}
+
+func TestParseTCPPacket_TruncatedOptions(t *testing.T) {
+	raw := []byte{
+		0, 80, 1, 187,
+		0, 0, 0, 1,
+		0, 0, 0, 0,
+		0x80, 0x02, 0xFF, 0xFF, // data offset 32 bytes
+		0, 0, 0, 0,
+		2, 4, 0x05, 0xB4,
+	}
+	tcp, err := pcap.ParseTCPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tcp.OptionsError() == nil {
+		t.Fail()
+	}
+	assertEqual(t, tcp.Options().MSS, uint16(1460))
+}
@@ -0,0 +1,60 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// https://en.wikipedia.org/wiki/User_Datagram_Protocol
+type udpHdr struct {
+	SourcePort uint16
+	DestPort   uint16
+	Length     uint16
+	Checksum   uint16
+}
+
+const udpHdrSize = 8
+
+type UdpPacket struct {
+	hdr  *udpHdr
+	Data []byte
+}
+
+func (f *UdpPacket) SourcePort() uint16 {
+	return f.hdr.SourcePort
+}
+
+func (f *UdpPacket) DestPort() uint16 {
+	return f.hdr.DestPort
+}
+
+// Length is the length of UDP header and payload, as stated in the header.
+func (f *UdpPacket) Length() uint16 {
+	return f.hdr.Length
+}
+
+// PayloadLength is the length of UDP payload, as stated in the header.
+func (f *UdpPacket) PayloadLength() uint16 {
+	return f.hdr.Length - udpHdrSize
+}
+
+func (f *UdpPacket) String() string {
+	return fmt.Sprintf("UDP %+v", f.hdr)
+}
+
+func ParseUDPPacket(raw []byte) (*UdpPacket, error) {
+	reader := bytes.NewReader(raw)
+	header := &udpHdr{}
+	err := binary.Read(reader, binary.BigEndian, header)
+	if err != nil {
+		return nil, err
+	}
+	if header.Length < udpHdrSize {
+		return nil, fmt.Errorf("Bad UDP length %d", header.Length)
+	}
+	return &UdpPacket{
+		hdr:  header,
+		Data: raw[udpHdrSize:],
+	}, nil
+}
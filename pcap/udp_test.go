@@ -0,0 +1,33 @@
+package pcap_test
+
+import (
+	"jakub-m/bdp/pcap"
+	"testing"
+)
+
+func TestParseUDPPacket(t *testing.T) {
+	raw := []byte{
+		0x14, 0xE9, 0, 53, // ports
+		0, 12, 0, 0, // length, checksum
+		1, 2, 3, 4,
+	}
+	udp, err := pcap.ParseUDPPacket(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, udp.SourcePort(), uint16(5353))
+	assertEqual(t, udp.DestPort(), uint16(53))
+	assertEqual(t, udp.PayloadLength(), uint16(4))
+	assertEqual(t, len(udp.Data), 4)
+}
+
+func TestParseUDPPacket_BadLength(t *testing.T) {
+	raw := []byte{
+		0x14, 0xE9, 0, 53,
+		0, 4, 0, 0, // length shorter than the header
+	}
+	_, err := pcap.ParseUDPPacket(raw)
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -2,22 +2,36 @@ package stats
 
 import (
 	"fmt"
+	"io"
 	"jakub-m/bdp/packet"
 	"jakub-m/bdp/pcap"
 	"sort"
+	"strings"
 )
 
+// vlans are VLAN IDs of the packet formatted as a string (so the key is comparable), e.g. "100.20".
+// Ports are zero for protocols other than TCP and UDP.
 type key struct {
-	source pcap.IPv4
-	dest   pcap.IPv4
+	source     pcap.IP
+	sourcePort uint16
+	dest       pcap.IP
+	destPort   uint16
+	protocol   uint8
+	vlans      string
+}
+
+// count is the number of packets with the key, and how many of them had bad checksums.
+type count struct {
+	packets      int
+	badChecksums int
 }
 
 type byCountT struct {
 	keys   []key
-	counts map[key]int
+	counts map[key]*count
 }
 
-func byCount(counts map[key]int) byCountT {
+func byCount(counts map[key]*count) byCountT {
 	keys := []key{}
 	for k := range counts {
 		keys = append(keys, k)
@@ -37,19 +51,81 @@ func (a byCountT) Swap(i, k int) {
 }
 
 func (a byCountT) Less(i, k int) bool {
-	return a.counts[a.keys[i]] < a.counts[a.keys[k]]
+	return a.counts[a.keys[i]].packets < a.counts[a.keys[k]].packets
 }
 
-func ProcessPackets(packets []*packet.Packet) {
-	counts := make(map[key]int)
-	for _, p := range packets {
-		counts[key{p.IP.SourceIP(), p.IP.DestIP()}]++
+// ProcessPackets prints packet counts per source and destination (IP and port) and protocol, with the counts of bad
+// checksums, and then the counts per protocol, per checksum status, and of truncated and oversized packets as
+// comments. If vlan is not nil, only the packets tagged with that VLAN ID are counted.
+func ProcessPackets(packets packet.Source, vlan *uint16) error {
+	counts := make(map[key]*count)
+	protocolCounts := make(map[uint8]int)
+	checksumCounts := make(map[pcap.ChecksumStatus]int)
+	truncated, oversized := 0, 0
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if vlan != nil && !p.HasVLAN(*vlan) {
+			continue
+		}
+		k := key{p.IP.SourceIP(), p.SourcePort(), p.IP.DestIP(), p.DestPort(), p.Protocol(), formatVLANs(p.VLANs())}
+		c, ok := counts[k]
+		if !ok {
+			c = &count{}
+			counts[k] = c
+		}
+		c.packets++
+		if p.Checksum() == pcap.ChecksumBad {
+			c.badChecksums++
+		}
+		protocolCounts[p.Protocol()]++
+		checksumCounts[p.Checksum()]++
+		if p.IsTruncated() {
+			truncated++
+		}
+		if p.IsOversized() {
+			oversized++
+		}
 	}
 
 	sorted := byCount(counts)
 	sort.Sort(sort.Reverse(sorted))
 
 	for _, k := range sorted.keys {
-		fmt.Printf("%s\t%s\t%d\n", k.source, k.dest, counts[k])
+		fmt.Printf("%s\t%d\t%s\t%d\t%s\t%s\t%d\t%d\n", k.source, k.sourcePort, k.dest, k.destPort, pcap.ProtocolName(k.protocol), k.vlans, counts[k].packets, counts[k].badChecksums)
+	}
+
+	protocols := []uint8{}
+	for p := range protocolCounts {
+		protocols = append(protocols, p)
+	}
+	sort.Slice(protocols, func(i, k int) bool { return protocols[i] < protocols[k] })
+	fmt.Println("# protocol\tcount")
+	for _, p := range protocols {
+		fmt.Printf("# %s\t%d\n", pcap.ProtocolName(p), protocolCounts[p])
+	}
+	fmt.Println("# checksum\tcount")
+	for _, s := range []pcap.ChecksumStatus{pcap.ChecksumGood, pcap.ChecksumBad, pcap.ChecksumOffloaded, pcap.ChecksumNotVerified} {
+		fmt.Printf("# %s\t%d\n", s, checksumCounts[s])
+	}
+	fmt.Println("# size\tcount")
+	fmt.Printf("# truncated\t%d\n", truncated)
+	fmt.Printf("# oversized\t%d\n", oversized)
+	return nil
+}
+
+func formatVLANs(vlans []uint16) string {
+	if len(vlans) == 0 {
+		return "-"
+	}
+	s := []string{}
+	for _, v := range vlans {
+		s = append(s, fmt.Sprintf("%d", v))
 	}
+	return strings.Join(s, ".")
 }